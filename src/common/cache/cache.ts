@@ -0,0 +1,6 @@
+export abstract class Cache<T> {
+  abstract get(key: string): Promise<T | undefined>;
+  // Concurrent writes of the same key must not interleave: the last write wins
+  abstract set(key: string, value: T): Promise<void>;
+  abstract delete(key: string): Promise<void>;
+}
@@ -0,0 +1,39 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { sleep } from '../../utils';
+
+import { InMemoryCache } from './in-memory.cache';
+
+describe('InMemoryCache', () => {
+  it('evicts the least recently written entry once it is full', async () => {
+    const cache = new InMemoryCache<string>(2);
+
+    await cache.set('a', 'first');
+    await cache.set('b', 'second');
+    await cache.set('a', 'third');
+    await cache.set('c', 'fourth');
+
+    assert.equal(await cache.get('a'), 'third');
+    assert.equal(await cache.get('b'), undefined);
+    assert.equal(await cache.get('c'), 'fourth');
+  });
+
+  it('keeps the last of concurrent writes of the same key', async () => {
+    const cache = new InMemoryCache<number>(1);
+
+    await Promise.all(Array.from({ length: 100 }, (_, index) => cache.set('key', index)));
+
+    assert.equal(await cache.get('key'), 99);
+  });
+
+  it('drops entries older than the TTL', async () => {
+    const cache = new InMemoryCache<string>(Infinity, 20);
+
+    await cache.set('key', 'value');
+    assert.equal(await cache.get('key'), 'value');
+
+    await sleep(30);
+    assert.equal(await cache.get('key'), undefined);
+  });
+});
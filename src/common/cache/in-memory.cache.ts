@@ -0,0 +1,42 @@
+import { Cache } from './cache';
+
+interface CacheEntry<T> {
+  value: T;
+  expiresAt: number;
+}
+
+export class InMemoryCache<T> extends Cache<T> {
+  private readonly entries: Map<string, CacheEntry<T>> = new Map();
+
+  // The TTL is in milliseconds, expired entries are dropped when they are read
+  constructor(
+    private readonly maxSize: number = Infinity,
+    private readonly ttl: number = Infinity,
+  ) {
+    super();
+  }
+
+  async get(key: string): Promise<T | undefined> {
+    const entry = this.entries.get(key);
+
+    if (entry && entry.expiresAt <= Date.now()) {
+      this.entries.delete(key);
+      return undefined;
+    }
+
+    return entry?.value;
+  }
+
+  async set(key: string, value: T): Promise<void> {
+    this.entries.delete(key);
+    this.entries.set(key, { value, expiresAt: Date.now() + this.ttl });
+
+    if (this.entries.size > this.maxSize) {
+      this.entries.delete(this.entries.keys().next().value);
+    }
+  }
+
+  async delete(key: string): Promise<void> {
+    this.entries.delete(key);
+  }
+}
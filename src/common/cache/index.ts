@@ -0,0 +1,3 @@
+export * from './cache';
+export * from './in-memory.cache';
+export * from './metered.cache';
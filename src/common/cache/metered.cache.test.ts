@@ -0,0 +1,54 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { Cache } from './cache';
+import { MeteredCache } from './metered.cache';
+
+// Answers from a fixed set of entries, so that the metrics only depend on the keys looked up
+class FakeCache extends Cache<string> {
+  constructor(private readonly entries: Record<string, string>) {
+    super();
+  }
+
+  async get(key: string): Promise<string | undefined> {
+    return this.entries[key];
+  }
+
+  async set(key: string, value: string): Promise<void> {
+    this.entries[key] = value;
+  }
+
+  async delete(key: string): Promise<void> {
+    delete this.entries[key];
+  }
+}
+
+describe('MeteredCache', () => {
+  it('records a hit and a miss', async () => {
+    const cache = new MeteredCache(new FakeCache({ cached: 'value' }), 'test');
+
+    assert.equal(await cache.get('cached'), 'value');
+    assert.equal(await cache.get('missing'), undefined);
+
+    const { hits, misses, averageLatency } = cache.getMetrics();
+
+    assert.equal(hits, 1);
+    assert.equal(misses, 1);
+    assert.ok(averageLatency >= 0);
+  });
+
+  it('passes writes through to the wrapped cache', async () => {
+    const cache = new MeteredCache(new FakeCache({}), 'test');
+
+    await cache.set('key', 'value');
+    assert.equal(await cache.get('key'), 'value');
+
+    await cache.delete('key');
+    assert.equal(await cache.get('key'), undefined);
+
+    const { hits, misses } = cache.getMetrics();
+
+    assert.equal(hits, 1);
+    assert.equal(misses, 1);
+  });
+});
@@ -0,0 +1,67 @@
+import { Logger } from '@nestjs/common';
+
+import { Cache } from './cache';
+
+export interface CacheMetrics {
+  hits: number;
+  misses: number;
+  averageLatency: number;
+}
+
+export class MeteredCache<T> extends Cache<T> {
+  private readonly logger: Logger;
+
+  private hits = 0;
+
+  private misses = 0;
+
+  private totalLatency = 0;
+
+  constructor(
+    private readonly cache: Cache<T>,
+    name: string,
+  ) {
+    super();
+    this.logger = new Logger(`${MeteredCache.name}:${name}`);
+  }
+
+  getMetrics(): CacheMetrics {
+    const lookups = this.hits + this.misses;
+
+    return {
+      hits: this.hits,
+      misses: this.misses,
+      averageLatency: lookups ? this.totalLatency / lookups : 0,
+    };
+  }
+
+  async get(key: string): Promise<T | undefined> {
+    const startedAt = performance.now();
+    const value = await this.cache.get(key);
+
+    this.totalLatency += performance.now() - startedAt;
+
+    if (value !== undefined) {
+      this.hits++;
+      return value;
+    }
+
+    this.misses++;
+
+    const { hits, misses, averageLatency } = this.getMetrics();
+    this.logger.debug(
+      `Miss for ${key} (hits: ${hits}, misses: ${misses}, ` +
+        `average latency: ${averageLatency.toFixed(2)}ms)`,
+    );
+
+    return undefined;
+  }
+
+  async set(key: string, value: T): Promise<void> {
+    await this.cache.set(key, value);
+  }
+
+  async delete(key: string): Promise<void> {
+    await this.cache.delete(key);
+  }
+}
@@ -0,0 +1,13 @@
+// Holds the current config. A reload swaps the whole object instead of changing it in place, so
+// a handler that captured the previous config keeps a consistent view of it until it finishes
+export class ConfigStore<T extends object> {
+  constructor(private current: T) {}
+
+  get(): T {
+    return this.current;
+  }
+
+  set(config: T): void {
+    this.current = config;
+  }
+}
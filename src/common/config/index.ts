@@ -0,0 +1 @@
+export * from './config-store';
@@ -0,0 +1,3 @@
+import { AppError } from './app.error';
+
+export class CompletionTimeoutError extends AppError {}
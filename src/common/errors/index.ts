@@ -1 +1,3 @@
 export { AppError } from './app.error';
+export { CompletionTimeoutError } from './completion-timeout.error';
+export { ServiceUnavailableError } from './service-unavailable.error';
@@ -0,0 +1,4 @@
+import { AppError } from './app.error';
+
+// The message is meant for users, unlike the one of a plain AppError
+export class ServiceUnavailableError extends AppError {}
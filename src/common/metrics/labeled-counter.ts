@@ -0,0 +1,19 @@
+export class LabeledCounter<L extends string> {
+  private readonly counts: Map<L, number> = new Map();
+
+  increment(label: L): number {
+    const count = this.get(label) + 1;
+
+    this.counts.set(label, count);
+
+    return count;
+  }
+
+  get(label: L): number {
+    return this.counts.get(label) ?? 0;
+  }
+
+  getAll(): Partial<Record<L, number>> {
+    return Object.fromEntries(this.counts) as Partial<Record<L, number>>;
+  }
+}
@@ -0,0 +1,82 @@
+import { strict as assert } from 'assert';
+import { rmSync, writeFileSync } from 'fs';
+import { after, afterEach, describe, it } from 'node:test';
+import { tmpdir } from 'os';
+import { join } from 'path';
+
+import { loadAnthropicConfig, loadConfigFile, loadDiscordConfig } from './load-config';
+
+const CONFIG_FILE = join(tmpdir(), `ai-discord-bot-config-${process.pid}.json`);
+
+const env = { ...process.env };
+
+const writeConfigFile = (content: unknown): void => {
+  writeFileSync(CONFIG_FILE, typeof content === 'string' ? content : JSON.stringify(content));
+  process.env.CONFIG_FILE = CONFIG_FILE;
+};
+
+describe('loadConfig', () => {
+  after(() => rmSync(CONFIG_FILE, { force: true }));
+
+  afterEach(() => {
+    for (const name of Object.keys(process.env)) {
+      if (!(name in env)) {
+        delete process.env[name];
+      }
+    }
+
+    Object.assign(process.env, env);
+  });
+
+  it('reads the options missing from the environment from the config file', () => {
+    writeConfigFile({
+      anthropic: { systemMessage: 'From file', anthropic: { model: 'claude-3-haiku-20240307' } },
+      discord: { replyPrefix: 'file: ' },
+    });
+
+    const configFile = loadConfigFile();
+
+    assert.equal(loadAnthropicConfig(configFile).systemMessage, 'From file');
+    assert.equal(loadAnthropicConfig(configFile).anthropic.model, 'claude-3-haiku-20240307');
+    assert.equal(loadDiscordConfig(configFile).replyPrefix, 'file: ');
+  });
+
+  it('prefers environment variables over the config file', () => {
+    writeConfigFile({
+      anthropic: {
+        systemMessage: 'From file',
+        anthropic: { model: 'claude-3-haiku-20240307', maxTokens: 1000 },
+      },
+      discord: { replyPrefix: 'file: ', maxReplyMessages: 2 },
+    });
+
+    process.env.SYSTEM_MESSAGE = 'From env';
+    process.env.ANTHROPIC_MAX_TOKENS = '2000';
+    process.env.REPLY_PREFIX = 'env: ';
+
+    const configFile = loadConfigFile();
+    const anthropicConfig = loadAnthropicConfig(configFile);
+    const discordConfig = loadDiscordConfig(configFile);
+
+    assert.equal(anthropicConfig.systemMessage, 'From env');
+    assert.equal(anthropicConfig.anthropic.model, 'claude-3-haiku-20240307');
+    assert.equal(anthropicConfig.anthropic.maxTokens, 2000);
+    assert.equal(discordConfig.replyPrefix, 'env: ');
+    assert.equal(discordConfig.maxReplyMessages, 2);
+  });
+
+  it('names a variable that is not a number', () => {
+    process.env.DISCORD_MAX_REPLY_MESSAGES = 'three';
+
+    assert.throws(
+      () => loadDiscordConfig({}),
+      /Cannot parse DISCORD_MAX_REPLY_MESSAGES: "three" is not a number/,
+    );
+  });
+
+  it('rejects a config file that is not JSON', () => {
+    writeConfigFile('anthropic: {}');
+
+    assert.throws(() => loadConfigFile(), /Cannot read config file/);
+  });
+});
@@ -0,0 +1,210 @@
+import { readFileSync } from 'fs';
+
+import { AppError } from '../common/errors';
+import { AnthropicConfig, VerbosityEnum } from '../modules/anthropic';
+import {
+  DiscordConfig,
+  FeatureFlagEnum,
+  HistoryTimestampsEnum,
+  MassMentionPolicyEnum,
+  MentionPolicyEnum,
+  PromptSanitizationEnum,
+  ResponseFormatEnum,
+} from '../modules/discord';
+
+export interface ConfigFile {
+  anthropic?: Partial<AnthropicConfig>;
+  discord?: Partial<DiscordConfig>;
+}
+
+// Read once per load and passed to both loaders, so they cannot see different versions of the file
+export const loadConfigFile = (): ConfigFile => {
+  if (!process.env.CONFIG_FILE) {
+    return {};
+  }
+
+  try {
+    return JSON.parse(readFileSync(process.env.CONFIG_FILE, 'utf8'));
+  } catch (error) {
+    throw new AppError(`Cannot read config file ${process.env.CONFIG_FILE}: ${error}`);
+  }
+};
+
+const parseJsonEnv = (name: keyof NodeJS.ProcessEnv) => {
+  const value = process.env[name];
+
+  if (!value) {
+    return undefined;
+  }
+
+  try {
+    return JSON.parse(value);
+  } catch (error) {
+    throw new AppError(`Cannot parse ${name}: ${error}`);
+  }
+};
+
+const parseNumberEnv = (name: keyof NodeJS.ProcessEnv): number | undefined => {
+  const value = process.env[name];
+
+  if (!value) {
+    return undefined;
+  }
+
+  const number = Number(value);
+
+  if (Number.isNaN(number)) {
+    throw new AppError(`Cannot parse ${name}: "${value}" is not a number`);
+  }
+
+  return number;
+};
+
+const withoutUndefined = <T extends object>(config: T): Partial<T> =>
+  Object.fromEntries(
+    Object.entries(config).filter(([, value]) => value !== undefined),
+  ) as Partial<T>;
+
+const loadAnthropicEnv = () => ({
+  systemMessage: process.env.SYSTEM_MESSAGE,
+  userMessageTemplate: process.env.USER_MESSAGE_TEMPLATE,
+  emptyMessagePlaceholder: process.env.EMPTY_MESSAGE_PLACEHOLDER,
+  maxAttachmentSize: parseNumberEnv('MAX_ATTACHMENT_SIZE'),
+  maxImagePayload: parseNumberEnv('MAX_IMAGE_PAYLOAD'),
+  maxImagePixels: parseNumberEnv('MAX_IMAGE_PIXELS'),
+  historyPrefetch: parseNumberEnv('HISTORY_PREFETCH'),
+  maxContextLength: parseNumberEnv('ANTHROPIC_MAX_CONTEXT_LENGTH'),
+  maxContextTokens: parseNumberEnv('ANTHROPIC_MAX_CONTEXT_TOKENS'),
+  streamIdleTimeout: parseNumberEnv('ANTHROPIC_STREAM_IDLE_TIMEOUT'),
+  authFailureThreshold: parseNumberEnv('ANTHROPIC_AUTH_FAILURE_THRESHOLD'),
+  unavailableNotice: process.env.ANTHROPIC_UNAVAILABLE_NOTICE,
+  codeLanguages: parseJsonEnv('CODE_LANGUAGES'),
+  verbosityPresets: parseJsonEnv('VERBOSITY_PRESETS'),
+  anthropic: {
+    apiKeys: process.env.ANTHROPIC_API_KEY?.split(',').filter(Boolean),
+    model: process.env.ANTHROPIC_MODEL,
+    maxTokens: parseNumberEnv('ANTHROPIC_MAX_TOKENS'),
+    temperature: parseNumberEnv('ANTHROPIC_TEMPERATURE'),
+    topK: parseNumberEnv('ANTHROPIC_TOP_K'),
+    topP: parseNumberEnv('ANTHROPIC_TOP_P'),
+    betas: process.env.ANTHROPIC_BETAS?.split(',').map((beta) => beta.trim()),
+  },
+});
+
+const loadDiscordEnv = () => ({
+  botToken: process.env.DISCORD_BOT_TOKEN,
+  adminIds: process.env.DISCORD_ADMIN_IDS?.split(',').filter(Boolean),
+  debugChannelId: process.env.DISCORD_DEBUG_CHANNEL_ID,
+  assistantIds: process.env.DISCORD_ASSISTANT_IDS?.split(',').filter(Boolean),
+  annotateAssistants: process.env.DISCORD_ANNOTATE_ASSISTANTS
+    ? process.env.DISCORD_ANNOTATE_ASSISTANTS === 'true'
+    : undefined,
+  features: process.env.FEATURE_FLAGS?.split(',').filter(Boolean) as FeatureFlagEnum[] | undefined,
+  attachmentsConcurrency: parseNumberEnv('ATTACHMENTS_CONCURRENCY'),
+  attachmentTimeout: parseNumberEnv('ATTACHMENT_TIMEOUT'),
+  maxAttachmentsPerMessage: parseNumberEnv('MAX_ATTACHMENTS_PER_MESSAGE'),
+  downloadRetries: parseNumberEnv('DOWNLOAD_RETRIES'),
+  replyMention: process.env.DISCORD_REPLY_MENTION
+    ? process.env.DISCORD_REPLY_MENTION === 'true'
+    : undefined,
+  allowMentions: process.env.DISCORD_ALLOW_MENTIONS
+    ? process.env.DISCORD_ALLOW_MENTIONS === 'true'
+    : undefined,
+  directMessages: process.env.DISCORD_DIRECT_MESSAGES
+    ? process.env.DISCORD_DIRECT_MESSAGES === 'true'
+    : undefined,
+  dmReplies: process.env.DISCORD_DM_REPLIES
+    ? process.env.DISCORD_DM_REPLIES === 'true'
+    : undefined,
+  dmHistoryMessages: parseNumberEnv('DISCORD_DM_HISTORY_MESSAGES'),
+  dmHistoryWindow: parseNumberEnv('DISCORD_DM_HISTORY_WINDOW'),
+  threadStarterContext: process.env.DISCORD_THREAD_STARTER_CONTEXT
+    ? process.env.DISCORD_THREAD_STARTER_CONTEXT === 'true'
+    : undefined,
+  foreignReplies: process.env.DISCORD_FOREIGN_REPLIES
+    ? process.env.DISCORD_FOREIGN_REPLIES === 'true'
+    : undefined,
+  refusalNotice: process.env.REFUSAL_NOTICE,
+  usageFooter: process.env.DISCORD_USAGE_FOOTER
+    ? process.env.DISCORD_USAGE_FOOTER === 'true'
+    : undefined,
+  modelPrices: parseJsonEnv('MODEL_PRICES'),
+  replyPrefix: process.env.REPLY_PREFIX,
+  replySuffix: process.env.REPLY_SUFFIX,
+  strippedPrefixes: parseJsonEnv('STRIPPED_PREFIXES'),
+  emptyCompletionRetries: parseNumberEnv('EMPTY_COMPLETION_RETRIES'),
+  busyNotice: process.env.BUSY_NOTICE,
+  busyThreshold: parseNumberEnv('BUSY_THRESHOLD'),
+  maintenanceNotice: process.env.MAINTENANCE_NOTICE,
+  channelQueueLimit: parseNumberEnv('CHANNEL_QUEUE_LIMIT'),
+  messageMergeWindow: parseNumberEnv('MESSAGE_MERGE_WINDOW'),
+  ackReaction: process.env.DISCORD_ACK_REACTION,
+  continueReaction: process.env.DISCORD_CONTINUE_REACTION,
+  minEditInterval: parseNumberEnv('DISCORD_MIN_EDIT_INTERVAL'),
+  maxEditFailures: parseNumberEnv('DISCORD_MAX_EDIT_FAILURES'),
+  fileThreshold: parseNumberEnv('DISCORD_FILE_THRESHOLD'),
+  maxReplyMessages: parseNumberEnv('DISCORD_MAX_REPLY_MESSAGES'),
+  longFormPreview: process.env.DISCORD_LONG_FORM_PREVIEW
+    ? process.env.DISCORD_LONG_FORM_PREVIEW === 'true'
+    : undefined,
+  promptDisplayLength: parseNumberEnv('DISCORD_PROMPT_DISPLAY_LENGTH'),
+  quotePrompt: process.env.DISCORD_QUOTE_PROMPT
+    ? process.env.DISCORD_QUOTE_PROMPT === 'true'
+    : undefined,
+  maintenance: process.env.DISCORD_MAINTENANCE
+    ? process.env.DISCORD_MAINTENANCE === 'true'
+    : undefined,
+  feedbackReactions: process.env.DISCORD_FEEDBACK_REACTIONS
+    ? process.env.DISCORD_FEEDBACK_REACTIONS === 'true'
+    : undefined,
+  reactionContext: process.env.DISCORD_REACTION_CONTEXT
+    ? process.env.DISCORD_REACTION_CONTEXT === 'true'
+    : undefined,
+  verbosity: process.env.VERBOSITY as VerbosityEnum | undefined,
+  responseLanguage: process.env.RESPONSE_LANGUAGE,
+  channelContext: process.env.CHANNEL_CONTEXT
+    ? process.env.CHANNEL_CONTEXT === 'true'
+    : undefined,
+  textEncoding: process.env.TEXT_ENCODING,
+  conversationTimeout: parseNumberEnv('CONVERSATION_TIMEOUT'),
+  regenerateCooldown: parseNumberEnv('REGENERATE_COOLDOWN'),
+  duplicateResponseWindow: parseNumberEnv('DUPLICATE_RESPONSE_WINDOW'),
+  userNamePrefix: process.env.USER_NAME_PREFIX
+    ? process.env.USER_NAME_PREFIX === 'true'
+    : undefined,
+  historyTimestamps: process.env.HISTORY_TIMESTAMPS as HistoryTimestampsEnum | undefined,
+  responseFormat: process.env.DISCORD_RESPONSE_FORMAT as ResponseFormatEnum | undefined,
+  promptSanitization: process.env.PROMPT_SANITIZATION as PromptSanitizationEnum | undefined,
+  mentionPolicy: process.env.MENTION_POLICY as MentionPolicyEnum | undefined,
+  stripBotMention: process.env.STRIP_BOT_MENTION
+    ? process.env.STRIP_BOT_MENTION === 'true'
+    : undefined,
+  massMentionPolicy: process.env.MASS_MENTION_POLICY as MassMentionPolicyEnum | undefined,
+  massMentionNotice: process.env.MASS_MENTION_NOTICE,
+  macros: parseJsonEnv('MACROS'),
+  minPromptLength: parseNumberEnv('MIN_PROMPT_LENGTH'),
+  urlContextDomains: process.env.URL_CONTEXT_DOMAINS?.split(',').filter(Boolean),
+  urlContextMaxLength: parseNumberEnv('URL_CONTEXT_MAX_LENGTH'),
+  guilds: parseJsonEnv('DISCORD_GUILDS'),
+});
+
+// Environment variables take precedence over values from CONFIG_FILE
+export const loadAnthropicConfig = (configFile: ConfigFile): AnthropicConfig => {
+  const file = configFile.anthropic ?? {};
+  const env = loadAnthropicEnv();
+
+  return {
+    ...file,
+    ...withoutUndefined(env),
+    anthropic: {
+      ...file.anthropic,
+      ...withoutUndefined(env.anthropic),
+    },
+  } as AnthropicConfig;
+};
+
+export const loadDiscordConfig = (configFile: ConfigFile): DiscordConfig =>
+  ({
+    ...configFile.discord,
+    ...withoutUndefined(loadDiscordEnv()),
+  }) as DiscordConfig;
@@ -0,0 +1,23 @@
+import * as dotenv from 'dotenv';
+
+const readEnvFile = (): dotenv.DotenvParseOutput => dotenv.config({ processEnv: {} }).parsed ?? {};
+
+// Variables applied from .env, read once on startup after dotenv/config loaded them
+let envFileKeys = Object.keys(readEnvFile());
+
+// dotenv never unsets anything, so the variables removed from .env since the last load are
+// deleted explicitly and their options fall back to the defaults.
+// Only the .env file in the working directory is re-read. Variables passed by docker compose
+// through env_file are set when the container is created and change only when it is recreated
+export const reloadEnv = (): void => {
+  const parsed = readEnvFile();
+
+  for (const key of envFileKeys) {
+    if (!(key in parsed)) {
+      delete process.env[key];
+    }
+  }
+
+  Object.assign(process.env, parsed);
+  envFileKeys = Object.keys(parsed);
+};
@@ -3,19 +3,94 @@ declare global {
     interface ProcessEnv {
       NODE_ENV: 'development' | 'production';
       LOG_LEVEL: string;
+      CONFIG_FILE?: string;
 
-      DISCORD_BOT_TOKEN: string;
+      DISCORD_BOT_TOKEN?: string;
+      DISCORD_ADMIN_IDS?: string;
+      DISCORD_DEBUG_CHANNEL_ID?: string;
+      DISCORD_ASSISTANT_IDS?: string;
+      DISCORD_ANNOTATE_ASSISTANTS?: string;
+      DISCORD_REPLY_MENTION?: string;
+      DISCORD_ALLOW_MENTIONS?: string;
+      DISCORD_DIRECT_MESSAGES?: string;
+      DISCORD_DM_REPLIES?: string;
+      DISCORD_DM_HISTORY_MESSAGES?: string;
+      DISCORD_DM_HISTORY_WINDOW?: string;
+      DISCORD_THREAD_STARTER_CONTEXT?: string;
+      DISCORD_FOREIGN_REPLIES?: string;
+      DISCORD_GUILDS?: string;
+      DISCORD_RESPONSE_FORMAT?: 'message' | 'embed';
+      DISCORD_ACK_REACTION?: string;
+      DISCORD_CONTINUE_REACTION?: string;
+      DISCORD_MIN_EDIT_INTERVAL?: string;
+      DISCORD_MAX_EDIT_FAILURES?: string;
+      DISCORD_FILE_THRESHOLD?: string;
+      DISCORD_MAX_REPLY_MESSAGES?: string;
+      DISCORD_LONG_FORM_PREVIEW?: string;
+      DISCORD_PROMPT_DISPLAY_LENGTH?: string;
+      DISCORD_QUOTE_PROMPT?: string;
+      DISCORD_MAINTENANCE?: string;
+      DISCORD_FEEDBACK_REACTIONS?: string;
+      DISCORD_REACTION_CONTEXT?: string;
+
+      FEATURE_FLAGS?: string;
 
       SYSTEM_MESSAGE?: string;
+      USER_MESSAGE_TEMPLATE?: string;
+      EMPTY_MESSAGE_PLACEHOLDER?: string;
       MAX_ATTACHMENT_SIZE?: string;
+      MAX_IMAGE_PAYLOAD?: string;
+      MAX_IMAGE_PIXELS?: string;
+      HISTORY_PREFETCH?: string;
+      ATTACHMENTS_CONCURRENCY?: string;
+      ATTACHMENT_TIMEOUT?: string;
+      MAX_ATTACHMENTS_PER_MESSAGE?: string;
+      DOWNLOAD_RETRIES?: string;
+      CODE_LANGUAGES?: string;
+      VERBOSITY_PRESETS?: string;
+      VERBOSITY?: 'concise' | 'normal' | 'detailed';
+      RESPONSE_LANGUAGE?: string;
+      CHANNEL_CONTEXT?: string;
+      TEXT_ENCODING?: string;
+      REFUSAL_NOTICE?: string;
+      DISCORD_USAGE_FOOTER?: string;
+      MODEL_PRICES?: string;
+      REPLY_PREFIX?: string;
+      REPLY_SUFFIX?: string;
+      STRIPPED_PREFIXES?: string;
+      EMPTY_COMPLETION_RETRIES?: string;
+      BUSY_NOTICE?: string;
+      BUSY_THRESHOLD?: string;
+      MAINTENANCE_NOTICE?: string;
+      CHANNEL_QUEUE_LIMIT?: string;
+      MESSAGE_MERGE_WINDOW?: string;
+      CONVERSATION_TIMEOUT?: string;
+      REGENERATE_COOLDOWN?: string;
+      DUPLICATE_RESPONSE_WINDOW?: string;
+      USER_NAME_PREFIX?: string;
+      HISTORY_TIMESTAMPS?: 'relative' | 'absolute';
+      PROMPT_SANITIZATION?: 'none' | 'control' | 'format';
+      MENTION_POLICY?: 'name' | 'strip' | 'context';
+      STRIP_BOT_MENTION?: string;
+      MASS_MENTION_POLICY?: 'allow' | 'warn' | 'refuse';
+      MASS_MENTION_NOTICE?: string;
+      MACROS?: string;
+      MIN_PROMPT_LENGTH?: string;
+      URL_CONTEXT_DOMAINS?: string;
+      URL_CONTEXT_MAX_LENGTH?: string;
 
-      ANTHROPIC_API_KEY: string;
-      ANTHROPIC_MODEL: string;
-      ANTHROPIC_MAX_TOKENS: string;
-      ANTHROPIC_MAX_CONTEXT_LENGTH: string;
+      ANTHROPIC_API_KEY?: string;
+      ANTHROPIC_MODEL?: string;
+      ANTHROPIC_MAX_TOKENS?: string;
+      ANTHROPIC_MAX_CONTEXT_LENGTH?: string;
+      ANTHROPIC_MAX_CONTEXT_TOKENS?: string;
+      ANTHROPIC_STREAM_IDLE_TIMEOUT?: string;
+      ANTHROPIC_AUTH_FAILURE_THRESHOLD?: string;
+      ANTHROPIC_UNAVAILABLE_NOTICE?: string;
       ANTHROPIC_TEMPERATURE?: string;
       ANTHROPIC_TOP_K?: string;
       ANTHROPIC_TOP_P?: string;
+      ANTHROPIC_BETAS?: string;
     }
   }
 }
@@ -0,0 +1,64 @@
+import { strict as assert } from 'assert';
+import { createServer, Server } from 'http';
+import { after, afterEach, before, describe, it } from 'node:test';
+
+import { SdkAnthropicClientFactory } from './anthropic-client.service';
+
+describe('SdkAnthropicClientFactory', () => {
+  const requests: Record<string, string | string[] | undefined>[] = [];
+
+  const baseUrl = process.env.ANTHROPIC_BASE_URL;
+
+  let server: Server;
+
+  // The SDK sends every request to ANTHROPIC_BASE_URL, here a server answering like count_tokens
+  before(async () => {
+    server = createServer((request, response) => {
+      requests.push(request.headers);
+      request.resume();
+      response.setHeader('content-type', 'application/json');
+      response.end(JSON.stringify({ input_tokens: 42 }));
+    });
+
+    await new Promise<void>((resolve) => server.listen(0, '127.0.0.1', resolve));
+
+    const { port } = server.address() as { port: number };
+
+    process.env.ANTHROPIC_BASE_URL = `http://127.0.0.1:${port}`;
+  });
+
+  afterEach(() => {
+    requests.length = 0;
+  });
+
+  after(async () => {
+    if (baseUrl === undefined) {
+      delete process.env.ANTHROPIC_BASE_URL;
+    } else {
+      process.env.ANTHROPIC_BASE_URL = baseUrl;
+    }
+
+    await new Promise((resolve) => server.close(resolve));
+  });
+
+  const countTokens = (betas?: string[]): Promise<number> =>
+    new SdkAnthropicClientFactory()
+      .create('sk-ant-test', { betas })
+      .countTokens({ model: 'claude-3-haiku-20240307', messages: [] });
+
+  it('sends the configured betas as the anthropic-beta header', async () => {
+    assert.equal(await countTokens(['output-128k-2025-02-19', 'pdfs-2024-09-25']), 42);
+
+    assert.equal(requests.length, 1);
+    assert.equal(requests[0]['anthropic-beta'], 'output-128k-2025-02-19,pdfs-2024-09-25');
+    assert.equal(requests[0]['x-api-key'], 'sk-ant-test');
+  });
+
+  it('sends no anthropic-beta header without betas', async () => {
+    await countTokens([]);
+    await countTokens();
+
+    assert.equal(requests.length, 2);
+    assert.ok(requests.every((headers) => !('anthropic-beta' in headers)));
+  });
+});
@@ -0,0 +1,50 @@
+import { Anthropic } from '@anthropic-ai/sdk';
+import { MessageParam } from '@anthropic-ai/sdk/resources';
+import { Injectable } from '@nestjs/common';
+
+export interface CountTokensParams {
+  model: string;
+  messages: MessageParam[];
+  system?: string;
+}
+
+export interface AnthropicClient {
+  apiKey: string | null;
+  messages: Pick<Anthropic['messages'], 'stream'>;
+  countTokens(params: CountTokensParams): Promise<number>;
+}
+
+export interface AnthropicClientOptions {
+  betas?: string[];
+}
+
+export abstract class AnthropicClientFactory {
+  abstract create(apiKey: string, options?: AnthropicClientOptions): AnthropicClient;
+}
+
+@Injectable()
+export class SdkAnthropicClientFactory extends AnthropicClientFactory {
+  create(apiKey: string, options: AnthropicClientOptions = {}): AnthropicClient {
+    const client = new Anthropic({
+      apiKey,
+      maxRetries: 10,
+      timeout: 30000,
+      defaultHeaders: options.betas?.length
+        ? { 'anthropic-beta': options.betas.join(',') }
+        : undefined,
+    });
+
+    return {
+      apiKey: client.apiKey,
+      messages: client.messages,
+      countTokens: async (params) => {
+        const response = await client.post<CountTokensParams, { input_tokens: number }>(
+          '/v1/messages/count_tokens',
+          { body: params },
+        );
+
+        return response.input_tokens;
+      },
+    };
+  }
+}
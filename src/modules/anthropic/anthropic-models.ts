@@ -0,0 +1,9 @@
+export const ANTHROPIC_MODELS = [
+  'claude-3-5-sonnet-20240620',
+  'claude-3-opus-20240229',
+  'claude-3-sonnet-20240229',
+  'claude-3-haiku-20240307',
+  'claude-2.1',
+  'claude-2.0',
+  'claude-instant-1.2',
+];
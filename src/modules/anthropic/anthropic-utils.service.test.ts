@@ -0,0 +1,163 @@
+import { ImageBlockParam, TextBlockParam } from '@anthropic-ai/sdk/resources';
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { createPng } from '../../testing/images';
+
+import { AnthropicUtilsService } from './anthropic-utils.service';
+import { AnthropicConfig, AnthropicConfigStore } from './anthropic.config';
+import { MessageRoleEnum } from './dto/enum';
+
+const setup = (config: Partial<AnthropicConfig> = {}) =>
+  new AnthropicUtilsService(
+    new AnthropicConfigStore({
+      maxContextLength: 100000,
+      anthropic: { apiKeys: ['sk-ant-key'], model: 'claude-3-haiku-20240307', maxTokens: 1000 },
+      ...config,
+    }),
+  );
+
+const getTexts = (content: unknown): string[] =>
+  (content as TextBlockParam[]).map((block) => block.text);
+
+describe('AnthropicUtilsService', () => {
+  describe('parseMessage', () => {
+    it('wraps a file in a fence longer than any backtick run in it', () => {
+      const service = setup();
+
+      const { content } = service.parseMessage({
+        role: MessageRoleEnum.USER,
+        content: '',
+        attachments: [
+          {
+            name: 'readme.md',
+            contentType: 'text/markdown',
+            content: Buffer.from('````\n```ts\ncode\n```\n````'),
+          },
+        ],
+      });
+
+      assert.deepEqual(getTexts(content), [
+        'readme.md:\n\n`````markdown\n````\n```ts\ncode\n```\n````\n`````',
+      ]);
+    });
+
+    it('reads a file with a BOM in its encoding', () => {
+      const service = setup();
+
+      const { content } = service.parseMessage({
+        role: MessageRoleEnum.USER,
+        content: '',
+        attachments: [
+          {
+            name: 'notes',
+            contentType: 'text/plain',
+            content: Buffer.concat([Buffer.from([0xff, 0xfe]), Buffer.from('Привет', 'utf16le')]),
+          },
+        ],
+      });
+
+      assert.deepEqual(getTexts(content), ['notes:\n\n```\nПривет\n```']);
+    });
+  });
+
+  describe('text encoding', () => {
+    it('decodes a file that is not UTF-8 with the encoding passed along', () => {
+      const service = setup();
+
+      // "Привет" in windows-1251
+      const content = Buffer.from([0xcf, 0xf0, 0xe8, 0xe2, 0xe5, 0xf2]);
+
+      const { content: blocks } = service.parseMessage({
+        role: MessageRoleEnum.USER,
+        content: '',
+        attachments: [
+          { name: 'notes.txt', contentType: 'text/plain', content, encoding: 'cp1251' },
+        ],
+      });
+
+      assert.deepEqual(getTexts(blocks), ['notes.txt:\n\n```\nПривет\n```']);
+    });
+  });
+
+  describe('image formats', () => {
+    const parseImage = (content: Buffer, contentType: string) =>
+      setup().parseMessage({
+        role: MessageRoleEnum.USER,
+        content: '',
+        attachments: [{ name: 'photo.png', contentType, content }],
+      }).content as Array<TextBlockParam | ImageBlockParam>;
+
+    it('passes a small PNG through unmodified with its actual media type', () => {
+      const png = createPng(64, 64, 1024);
+
+      // Discord reported the wrong type for the upload
+      assert.deepEqual(parseImage(png, 'image/jpeg'), [
+        {
+          type: 'image',
+          source: { type: 'base64', media_type: 'image/png', data: png.toString('base64') },
+        },
+      ]);
+    });
+
+    it('omits a PNG over the size limit', () => {
+      // Base64 grows the file by a third, over the 5 MB the API accepts
+      const png = createPng(2000, 2000, 4 * 1024 * 1024);
+
+      assert.deepEqual(parseImage(png, 'image/png'), [
+        { type: 'text', text: '(photo.png: image omitted, it exceeds the 5 MB limit)' },
+      ]);
+    });
+
+    it('omits an image in a format the API does not accept', () => {
+      const bmp = Buffer.concat([Buffer.from('BM'), Buffer.alloc(64)]);
+
+      assert.deepEqual(parseImage(bmp, 'image/png'), [
+        { type: 'text', text: '(photo.png: image omitted, its format is not supported)' },
+      ]);
+    });
+  });
+
+  describe('image dimensions', () => {
+    const parseImage = (service: AnthropicUtilsService, content: Buffer) =>
+      service.parseMessage({
+        role: MessageRoleEnum.USER,
+        content: '',
+        attachments: [{ name: 'bomb.png', contentType: 'image/png', content }],
+      }).content as Array<TextBlockParam | ImageBlockParam>;
+
+    it('omits a small file declaring huge dimensions', () => {
+      const service = setup();
+
+      assert.deepEqual(parseImage(service, createPng(100000, 100000)), [
+        { type: 'text', text: '(bomb.png: image omitted, its dimensions are too large)' },
+      ]);
+    });
+
+    it('uses the configured pixel bound', () => {
+      const service = setup({ maxImagePixels: 100 * 100 });
+
+      assert.equal(parseImage(service, createPng(100, 100))[0].type, 'image');
+      assert.equal(parseImage(service, createPng(101, 100))[0].type, 'text');
+    });
+  });
+
+  describe('truncateMessage', () => {
+    it('does not cut a surrogate pair', () => {
+      const service = setup();
+      const text = '😀'.repeat(10);
+
+      // The truncation marker takes 20 characters, every limit tried leaves room for some text
+      for (let maxLength = 22; maxLength < 40; maxLength++) {
+        const { content } = service.truncateMessage(
+          { role: MessageRoleEnum.USER, content: text },
+          maxLength,
+        );
+        const [truncated] = getTexts(content);
+
+        assert.ok(text.startsWith(truncated));
+        assert.ok(!/[\ud800-\udbff]$/.test(truncated));
+      }
+    });
+  });
+});
@@ -1,15 +1,41 @@
 import { ImageBlockParam, MessageParam, TextBlockParam } from '@anthropic-ai/sdk/resources';
-import { Injectable } from '@nestjs/common';
+import { Inject, Injectable } from '@nestjs/common';
 
-import { CompletionMessage } from './dto/common';
+import { decodeText, getImageSize, getImageType } from '../../utils';
+
+import { AnthropicConfig, AnthropicConfigStore } from './anthropic.config';
+import { CODE_LANGUAGES_BY_CONTENT_TYPE, CODE_LANGUAGES_BY_EXTENSION } from './code-languages';
+import { CompletionAttachment, CompletionMessage } from './dto/common';
 import { MessageRoleEnum } from './dto/enum';
 
+const TRUNCATION_MARKER = '[…message truncated]';
+
+const MAX_IMAGE_SIZE = 5 * 1024 * 1024;
+
+const CHARS_PER_TOKEN = 4;
+
+const IMAGE_TOKENS = 1600;
+
+const DEFAULT_MAX_IMAGE_PIXELS = 8000 * 8000;
+
+const DEFAULT_EMPTY_MESSAGE_PLACEHOLDER = '(empty message)';
+
 @Injectable()
 export class AnthropicUtilsService {
+  constructor(
+    @Inject(AnthropicConfigStore)
+    private configStore: AnthropicConfigStore,
+  ) {}
+
+  private get config(): AnthropicConfig {
+    return this.configStore.get();
+  }
+
   parseMessage(message: CompletionMessage): MessageParam {
+    const role = this.mapRole(message.role);
     const content: Array<TextBlockParam | ImageBlockParam> = [];
 
-    if (message.content) {
+    if (message.content?.trim()) {
       content.push({
         type: 'text',
         text: message.content,
@@ -19,29 +45,86 @@ export class AnthropicUtilsService {
     if (message.attachments?.length) {
       for (const attachment of message.attachments) {
         if (attachment.contentType?.split('/').at(0) === 'image') {
-          content.push({
-            type: 'image',
-            source: {
-              type: 'base64',
-              media_type: attachment.contentType as 'image/jpeg',
-              data: attachment.content.toString('base64'),
-            },
-          });
+          const data = attachment.content.toString('base64');
+          const mediaType = getImageType(attachment.content);
+
+          // Only user turns may carry images, the API rejects them in assistant turns
+          if (role === 'assistant') {
+            content.push({
+              type: 'text',
+              text: `(${attachment.name ?? 'image'}: image)`,
+            });
+          } else if (data.length > MAX_IMAGE_SIZE) {
+            content.push({
+              type: 'text',
+              text: `(${attachment.name ?? 'image'}: image omitted, it exceeds the 5 MB limit)`,
+            });
+          } else if (!mediaType) {
+            // The API only accepts JPEG, PNG, GIF and WebP, and rejects the whole request otherwise
+            content.push({
+              type: 'text',
+              text: `(${attachment.name ?? 'image'}: image omitted, its format is not supported)`,
+            });
+          } else if (this.isImageTooLarge(attachment)) {
+            content.push({
+              type: 'text',
+              text: `(${attachment.name ?? 'image'}: image omitted, its dimensions are too large)`,
+            });
+          } else {
+            // Images are sent as uploaded, with the media type of their actual format
+            content.push({
+              type: 'image',
+              source: {
+                type: 'base64',
+                media_type: mediaType,
+                data,
+              },
+            });
+          }
+
+          if (attachment.extractedText) {
+            content.push({
+              type: 'text',
+              text: `${attachment.name ?? 'image'} (extracted text):\n\n${attachment.extractedText}`,
+            });
+          }
         } else {
+          const language = this.getCodeLanguage(attachment.name, attachment.contentType);
+          const text = decodeText(attachment.content, attachment.encoding);
+          const fence = this.getCodeFence(text);
+
           content.push({
             type: 'text',
-            text: `${attachment.name}${attachment.contentType ? ` ${attachment.contentType}` : ''}:\n\n${attachment.content.toString()}`,
+            text: `${attachment.name ?? 'file'}:\n\n${fence}${language}\n${text}\n${fence}`,
           });
         }
       }
     }
 
+    // The API rejects turns without content, e.g. a history reply that was cleared or a bare embed
+    if (!content.length) {
+      content.push({
+        type: 'text',
+        text: this.config.emptyMessagePlaceholder ?? DEFAULT_EMPTY_MESSAGE_PLACEHOLDER,
+      });
+    }
+
     return {
-      role: this.mapRole(message.role),
+      role,
       content,
     };
   }
 
+  // Checked against the image header before anything decodes the image, so a small file that
+  // declares huge dimensions cannot exhaust memory
+  isImageTooLarge(attachment: CompletionAttachment): boolean {
+    const size = getImageSize(attachment.content);
+
+    return (
+      !!size && size.width * size.height > (this.config.maxImagePixels ?? DEFAULT_MAX_IMAGE_PIXELS)
+    );
+  }
+
   getMessageLength(message: MessageParam) {
     if (typeof message.content === 'string') {
       return message.content.length;
@@ -64,6 +147,126 @@ export class AnthropicUtilsService {
     }, 0);
   }
 
+  estimateTokens(messages: MessageParam[], system: string = ''): number {
+    let tokens = Math.ceil(system.length / CHARS_PER_TOKEN);
+
+    for (const message of messages) {
+      const blocks =
+        typeof message.content === 'string'
+          ? [{ type: 'text' as const, text: message.content }]
+          : message.content;
+
+      for (const block of blocks) {
+        if (block.type === 'text') {
+          tokens += Math.ceil(block.text.length / CHARS_PER_TOKEN);
+        } else if (block.type === 'image') {
+          tokens += IMAGE_TOKENS;
+        }
+      }
+    }
+
+    return tokens;
+  }
+
+  limitImagePayload(messages: MessageParam[], maxSize: number): MessageParam[] {
+    let total = messages.reduce(
+      (acc, message) =>
+        typeof message.content === 'string'
+          ? acc
+          : message.content.reduce(
+              (acc, block) => (block.type === 'image' ? acc + block.source.data.length : acc),
+              acc,
+            ),
+      0,
+    );
+
+    // Oldest images are dropped first so the current message keeps its own as long as possible
+    return messages.map((message) => {
+      if (total <= maxSize || typeof message.content === 'string') {
+        return message;
+      }
+
+      return {
+        ...message,
+        content: message.content.map((block): TextBlockParam | ImageBlockParam => {
+          if (block.type !== 'image' || total <= maxSize) {
+            return block;
+          }
+
+          total -= block.source.data.length;
+
+          return {
+            type: 'text',
+            text: '(image omitted: the request image size limit was reached)',
+          };
+        }),
+      };
+    });
+  }
+
+  truncateMessage(message: MessageParam, maxLength: number): MessageParam {
+    const blocks: Array<TextBlockParam | ImageBlockParam> =
+      typeof message.content === 'string'
+        ? [{ type: 'text', text: message.content }]
+        : message.content;
+
+    const content: Array<TextBlockParam | ImageBlockParam> = [];
+
+    let length = 0;
+
+    for (const block of blocks) {
+      const blockLength = this.getMessageLength({ role: message.role, content: [block] });
+
+      if (length + blockLength + TRUNCATION_MARKER.length <= maxLength) {
+        content.push(block);
+        length += blockLength;
+      } else if (block.type === 'text') {
+        let available = Math.max(0, maxLength - length - TRUNCATION_MARKER.length);
+
+        const code = block.text.charCodeAt(available - 1);
+
+        if (code >= 0xd800 && code <= 0xdbff) {
+          available -= 1;
+        }
+
+        const text = block.text.slice(0, available);
+
+        if (text) {
+          content.push({ type: 'text', text });
+          length += text.length;
+        }
+      }
+    }
+
+    content.push({ type: 'text', text: TRUNCATION_MARKER });
+
+    return {
+      role: message.role,
+      content,
+    };
+  }
+
+  getCodeLanguage(name: string = '', contentType?: string): string {
+    const extension = name.includes('.') ? name.split('.').at(-1)?.toLowerCase() : undefined;
+
+    if (extension) {
+      const language = {
+        ...CODE_LANGUAGES_BY_EXTENSION,
+        ...this.config.codeLanguages,
+      }[extension];
+
+      if (language) {
+        return language;
+      }
+    }
+
+    if (contentType) {
+      return CODE_LANGUAGES_BY_CONTENT_TYPE[contentType.split(';')[0].trim()] ?? '';
+    }
+
+    return '';
+  }
+
   mapRole(role: MessageRoleEnum): MessageParam['role'] {
     return (
       {
@@ -72,4 +275,13 @@ export class AnthropicUtilsService {
       }[role] ?? ('user' as const)
     );
   }
+
+  private getCodeFence(text: string): string {
+    const longestRun = (text.match(/`{3,}/g) ?? []).reduce(
+      (max, run) => Math.max(max, run.length),
+      0,
+    );
+
+    return '`'.repeat(Math.max(3, longestRun + 1));
+  }
 }
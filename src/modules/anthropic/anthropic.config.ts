@@ -1,14 +1,153 @@
+import { Type as Constructor } from '@nestjs/common';
+import { Type } from 'class-transformer';
+import {
+  ArrayNotEmpty,
+  IsIn,
+  IsInt,
+  IsNotEmpty,
+  IsObject,
+  IsOptional,
+  IsPositive,
+  IsString,
+  Matches,
+  Max,
+  Min,
+  ValidateNested,
+} from 'class-validator';
+
+import { ConfigStore } from '../../common/config';
+import { IsTemplate, ValidateRecord } from '../../utils';
+
+import { AnthropicClientFactory } from './anthropic-client.service';
+import { ANTHROPIC_MODELS } from './anthropic-models';
+import { VerbosityEnum } from './dto/enum';
+import { ImagePreprocessor } from './image-preprocessor.service';
+
+export class VerbosityPreset {
+  @IsOptional()
+  @IsString()
+  instruction?: string;
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  maxTokens?: number;
+}
+
+export class AnthropicApiConfig {
+  @ArrayNotEmpty()
+  @Matches(/^sk-ant-[\w-]+$/, {
+    each: true,
+    message: 'apiKeys must contain only well-formed Anthropic API keys (sk-ant-...)',
+  })
+  apiKeys: string[];
+
+  @IsIn(ANTHROPIC_MODELS)
+  model: string;
+
+  @IsInt()
+  @IsPositive()
+  maxTokens: number;
+
+  @IsOptional()
+  @Min(0)
+  @Max(1)
+  temperature?: number;
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  topK?: number;
+
+  @IsOptional()
+  @Min(0)
+  @Max(1)
+  topP?: number;
+
+  // Sent as the anthropic-beta header with every request, e.g. output-128k-2025-02-19
+  @IsOptional()
+  @IsString({ each: true })
+  @IsNotEmpty({ each: true })
+  betas?: string[];
+}
+
 export class AnthropicConfig {
+  // Templates are rendered with PromptTemplateData, see renderTemplate for the syntax
+  @IsOptional()
+  @IsTemplate()
   systemMessage?: string;
+
+  // Wraps the text of the prompt, which is available as {{content}}
+  @IsOptional()
+  @IsTemplate()
+  userMessageTemplate?: string;
+
+  @IsOptional()
+  @IsString()
+  @IsNotEmpty()
+  emptyMessagePlaceholder?: string;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
   maxAttachmentSize?: number;
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  maxImagePayload?: number;
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  maxImagePixels?: number;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  historyPrefetch?: number;
+
+  @IsInt()
+  @IsPositive()
   maxContextLength: number;
 
-  anthropic: {
-    apiKeys: string[];
-    model: string;
-    maxTokens: number;
-    temperature?: number;
-    topK?: number;
-    topP?: number;
-  };
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  maxContextTokens?: number;
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  streamIdleTimeout?: number;
+
+  // Consecutive 401/403 responses after which the key is considered revoked
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  authFailureThreshold?: number;
+
+  // Shown to users instead of the usual error while the key is revoked
+  @IsOptional()
+  @IsString()
+  @IsNotEmpty()
+  unavailableNotice?: string;
+
+  imagePreprocessor?: Constructor<ImagePreprocessor>;
+
+  clientFactory?: Constructor<AnthropicClientFactory>;
+
+  @IsOptional()
+  @IsObject()
+  codeLanguages?: Record<string, string>;
+
+  @IsOptional()
+  @ValidateRecord(() => VerbosityPreset)
+  verbosityPresets?: Partial<Record<VerbosityEnum, VerbosityPreset>>;
+
+  @ValidateNested()
+  @Type(() => AnthropicApiConfig)
+  anthropic: AnthropicApiConfig;
 }
+
+export class AnthropicConfigStore extends ConfigStore<AnthropicConfig> {}
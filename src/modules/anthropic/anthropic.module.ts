@@ -1,17 +1,33 @@
 import { DynamicModule, Module, Provider } from '@nestjs/common';
 
+import { validateConfig } from '../../utils';
+
+import { AnthropicClientFactory, SdkAnthropicClientFactory } from './anthropic-client.service';
 import { AnthropicUtilsService } from './anthropic-utils.service';
-import { AnthropicConfig } from './anthropic.config';
+import { AnthropicConfig, AnthropicConfigStore } from './anthropic.config';
 import { AnthropicService } from './anthropic.service';
+import { ImagePreprocessor, NoopImagePreprocessor } from './image-preprocessor.service';
 
 @Module({})
 export class AnthropicModule {
   private static configProvider: Provider;
+  private static imagePreprocessorProvider: Provider;
+  private static clientFactoryProvider: Provider;
 
   static forRoot(config: AnthropicConfig): DynamicModule {
     this.configProvider = {
-      provide: AnthropicConfig,
-      useValue: config,
+      provide: AnthropicConfigStore,
+      useValue: new AnthropicConfigStore(validateConfig(AnthropicConfig, config)),
+    };
+
+    this.imagePreprocessorProvider = {
+      provide: ImagePreprocessor,
+      useClass: config.imagePreprocessor ?? NoopImagePreprocessor,
+    };
+
+    this.clientFactoryProvider = {
+      provide: AnthropicClientFactory,
+      useClass: config.clientFactory ?? SdkAnthropicClientFactory,
     };
 
     return {
@@ -26,7 +42,13 @@ export class AnthropicModule {
     return {
       module: AnthropicModule,
       imports: [],
-      providers: [AnthropicService, AnthropicUtilsService, this.configProvider],
+      providers: [
+        AnthropicService,
+        AnthropicUtilsService,
+        this.configProvider,
+        this.imagePreprocessorProvider,
+        this.clientFactoryProvider,
+      ],
       exports: [AnthropicService],
     };
   }
@@ -0,0 +1,343 @@
+import { APIConnectionError, APIConnectionTimeoutError, APIError } from '@anthropic-ai/sdk';
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+import { lastValueFrom, Observable, toArray } from 'rxjs';
+
+import { AppError, CompletionTimeoutError, ServiceUnavailableError } from '../../common/errors';
+import { FakeAnthropicClientFactory } from '../../testing/fake-anthropic';
+import { createPng } from '../../testing/images';
+import { sleep } from '../../utils';
+
+import { AnthropicUtilsService } from './anthropic-utils.service';
+import { AnthropicConfig, AnthropicConfigStore } from './anthropic.config';
+import { AnthropicService } from './anthropic.service';
+import { CompletionFailureEnum, MessageRoleEnum } from './dto/enum';
+import { CreateCompletionResultDto } from './dto/internal';
+import { ImagePreprocessor, NoopImagePreprocessor } from './image-preprocessor.service';
+
+const setup = (
+  config: Partial<AnthropicConfig> = {},
+  imagePreprocessor: ImagePreprocessor = new NoopImagePreprocessor(),
+) => {
+  const configStore = new AnthropicConfigStore({
+    maxContextLength: 100000,
+    maxAttachmentSize: 1024 * 1024,
+    anthropic: {
+      apiKeys: ['sk-ant-first', 'sk-ant-second'],
+      model: 'claude-3-haiku-20240307',
+      maxTokens: 1000,
+    },
+    ...config,
+  });
+  const factory = new FakeAnthropicClientFactory();
+
+  const service = new AnthropicService(
+    configStore,
+    new AnthropicUtilsService(configStore),
+    imagePreprocessor,
+    factory,
+  );
+
+  return { service, configStore, factory };
+};
+
+const PROMPT = { role: MessageRoleEnum.USER, content: 'Привет' };
+
+// Subscribes right away, the completion does not replay the events emitted before
+const collect = (
+  completion: Observable<CreateCompletionResultDto>,
+): Promise<CreateCompletionResultDto[]> => lastValueFrom(completion.pipe(toArray()));
+
+describe('AnthropicService', () => {
+  describe('stream events', () => {
+    it('maps the text and the final message of a stream to completion results', async () => {
+      const { service, factory } = setup();
+
+      const completion = collect(await service.createCompletion({ message: PROMPT }));
+      factory.lastStream.respond(['При', 'вет'], 'max_tokens', {
+        input_tokens: 12,
+        output_tokens: 3,
+      });
+
+      assert.deepEqual(await completion, [
+        { chunk: 'При' },
+        { chunk: 'вет' },
+        {
+          chunk: '',
+          stopReason: 'max_tokens',
+          usage: { model: 'claude-3-haiku-20240307', inputTokens: 12, outputTokens: 3 },
+        },
+      ]);
+      assert.deepEqual(factory.lastStream.params.messages, [
+        { role: 'user', content: [{ type: 'text', text: 'Привет' }] },
+      ]);
+    });
+  });
+
+  describe('idle timeout', () => {
+    it('aborts a stream that stalls after connecting', async () => {
+      const { service, factory } = setup({ streamIdleTimeout: 20 });
+
+      const completion = collect(await service.createCompletion({ message: PROMPT }));
+      const stream = factory.lastStream;
+
+      stream.emit('connect');
+      stream.emit('text', 'Начало', 'Начало');
+
+      await assert.rejects(completion, CompletionTimeoutError);
+      assert.ok(stream.aborted);
+      assert.deepEqual(service.getFailureCounts(), { [CompletionFailureEnum.TIMEOUT]: 1 });
+    });
+
+    it('waits for the connection without a timeout', async () => {
+      const { service, factory } = setup({ streamIdleTimeout: 20 });
+
+      const completion = collect(await service.createCompletion({ message: PROMPT }));
+
+      await sleep(40);
+      factory.lastStream.respond(['Hello']);
+
+      assert.equal((await completion)[0].chunk, 'Hello');
+      assert.ok(!factory.lastStream.aborted);
+    });
+  });
+
+  describe('history', () => {
+    it('trims the history to the token budget counted by the API', async () => {
+      const { service, factory } = setup({ maxContextTokens: 100 });
+
+      let running = 0;
+      let maxRunning = 0;
+
+      // The prompt takes 10 tokens and every message of the history 40
+      factory.countTokens = async ({ messages }) => {
+        running++;
+        maxRunning = Math.max(maxRunning, running);
+
+        await sleep(10);
+
+        running--;
+
+        return JSON.stringify(messages).includes('Привет') ? 10 : 40;
+      };
+
+      const history = [0, 1, 2, 3, 4].map((index) => ({
+        role: index % 2 ? MessageRoleEnum.USER : MessageRoleEnum.ASSISTANT,
+        content: `Сообщение ${index}`,
+      }));
+
+      const completion = collect(
+        await service.createCompletion({
+          message: PROMPT,
+          getPreviousMessage: async () => history.shift() ?? null,
+        }),
+      );
+      factory.lastStream.respond(['Hello']);
+      await completion;
+
+      assert.deepEqual(
+        factory.lastStream.params.messages.map(({ content }) => content),
+        ['Сообщение 1', 'Сообщение 0', 'Привет'].map((text) => [{ type: 'text', text }]),
+      );
+      assert.ok(maxRunning > 1);
+    });
+  });
+
+  describe('image preprocessing', () => {
+    const message = {
+      role: MessageRoleEnum.USER,
+      content: 'Что тут написано?',
+      attachments: [{ content: createPng(100, 100), contentType: 'image/png', name: 'screen.png' }],
+    };
+
+    it('sends the text extracted by the preprocessor along with the image', async () => {
+      const { service, factory } = setup({}, { process: async () => 'Hello from the screenshot' });
+
+      const completion = collect(await service.createCompletion({ message }));
+      factory.lastStream.respond(['Hello']);
+      await completion;
+
+      const content = factory.lastStream.params.messages.at(-1)?.content;
+
+      assert.ok(Array.isArray(content));
+      assert.deepEqual(content.map((block) => block.type), ['text', 'image', 'text']);
+      assert.deepEqual(content[2], {
+        type: 'text',
+        text: 'screen.png (extracted text):\n\nHello from the screenshot',
+      });
+    });
+
+    it('sends the image alone when the preprocessor extracts nothing or fails', async () => {
+      for (const imagePreprocessor of [
+        new NoopImagePreprocessor(),
+        { process: () => Promise.reject(new Error('OCR failed')) },
+      ]) {
+        const { service, factory } = setup({}, imagePreprocessor);
+
+        const completion = collect(await service.createCompletion({ message }));
+        factory.lastStream.respond(['Hello']);
+        await completion;
+
+        const content = factory.lastStream.params.messages.at(-1)?.content;
+
+        assert.ok(Array.isArray(content));
+        assert.deepEqual(content.map((block) => block.type), ['text', 'image']);
+      }
+    });
+  });
+
+  describe('stream errors', () => {
+    it('passes on the text received before an error mid-stream', async () => {
+      const { service, factory } = setup();
+
+      const values: CreateCompletionResultDto[] = [];
+      const completion = await service.createCompletion({ message: PROMPT });
+      const result = completion.forEach((value) => values.push(value));
+
+      const stream = factory.lastStream;
+
+      stream.emit('connect');
+      stream.emit('text', 'Начало', 'Начало');
+      stream.emit('error', new APIError(529, undefined, 'Overloaded', {}));
+
+      await assert.rejects(result, AppError);
+      assert.deepEqual(values, [{ chunk: 'Начало' }]);
+      assert.deepEqual(service.getFailureCounts(), { [CompletionFailureEnum.OVERLOADED]: 1 });
+    });
+  });
+
+  describe('failure counts', () => {
+    it('counts every failure under its type', async () => {
+      const { service, factory } = setup({ authFailureThreshold: 100 });
+
+      const errors = [
+        new APIError(429, undefined, 'Rate limited', {}),
+        new APIError(529, undefined, 'Overloaded', {}),
+        new APIError(401, undefined, 'Invalid API key', {}),
+        new APIError(400, undefined, 'Bad request', {}),
+        new APIError(500, undefined, 'Internal error', {}),
+        new APIError(503, undefined, 'Unavailable', {}),
+        new APIConnectionError({ message: 'Connection reset' }),
+        new APIConnectionTimeoutError(),
+        new Error('Unexpected'),
+      ];
+
+      for (const error of errors) {
+        const completion = collect(await service.createCompletion({ message: PROMPT }));
+        factory.lastStream.emit('error', error);
+        await assert.rejects(completion);
+      }
+
+      assert.deepEqual(service.getFailureCounts(), {
+        [CompletionFailureEnum.RATE_LIMITED]: 1,
+        [CompletionFailureEnum.OVERLOADED]: 1,
+        [CompletionFailureEnum.AUTH]: 1,
+        [CompletionFailureEnum.BAD_REQUEST]: 1,
+        [CompletionFailureEnum.SERVER]: 2,
+        [CompletionFailureEnum.NETWORK]: 1,
+        [CompletionFailureEnum.TIMEOUT]: 1,
+        [CompletionFailureEnum.UNKNOWN]: 1,
+      });
+    });
+
+    it('does not count aborts requested by the user', async () => {
+      const { service, factory } = setup();
+      const abortController = new AbortController();
+
+      const completion = collect(
+        await service.createCompletion({ message: PROMPT, signal: abortController.signal }),
+      );
+      abortController.abort();
+      await assert.rejects(completion);
+
+      assert.ok(factory.lastStream.aborted);
+      assert.deepEqual(service.getFailureCounts(), {});
+    });
+  });
+
+  describe('degraded state', () => {
+    it('replies with the notice after repeated auth errors until a request succeeds', async () => {
+      const { service, configStore, factory } = setup({
+        authFailureThreshold: 3,
+        unavailableNotice: 'Бот временно недоступен',
+      });
+
+      const fail = async (): Promise<unknown> => {
+        const completion = collect(await service.createCompletion({ message: PROMPT }));
+        factory.lastStream.emit('error', new APIError(401, undefined, 'Invalid API key', {}));
+        return await completion.catch((error) => error);
+      };
+
+      for (let attempt = 0; attempt < 2; attempt++) {
+        const error = await fail();
+
+        assert.ok(error instanceof AppError && !(error instanceof ServiceUnavailableError));
+        assert.equal(service.getUnavailableSince(), null);
+      }
+
+      for (let attempt = 0; attempt < 2; attempt++) {
+        const error = await fail();
+
+        assert.ok(error instanceof ServiceUnavailableError);
+        assert.equal(error.message, 'Бот временно недоступен');
+        assert.ok(service.getUnavailableSince());
+      }
+
+      const config = configStore.get();
+
+      service.updateConfig({
+        ...config,
+        anthropic: { ...config.anthropic, apiKeys: ['sk-ant-new'] },
+      });
+
+      const completion = collect(await service.createCompletion({ message: PROMPT }));
+      factory.lastStream.respond(['Hello']);
+      await completion;
+
+      assert.equal(service.getUnavailableSince(), null);
+      assert.equal(factory.clients.at(-1)?.apiKey, 'sk-ant-new');
+    });
+  });
+
+  describe('reload', () => {
+    it('sends the new system message with new requests only', async () => {
+      const { service, configStore, factory } = setup({ systemMessage: 'Old' });
+
+      const inFlight = collect(await service.createCompletion({ message: PROMPT }));
+      const previous = factory.lastStream;
+
+      service.updateConfig({ ...configStore.get(), systemMessage: 'New' });
+
+      const next = collect(await service.createCompletion({ message: PROMPT }));
+
+      previous.respond(['Первый']);
+      factory.lastStream.respond(['Второй']);
+
+      assert.equal((await inFlight)[0].chunk, 'Первый');
+      assert.equal((await next)[0].chunk, 'Второй');
+      assert.equal(previous.params.system, 'Old');
+      assert.equal(factory.lastStream.params.system, 'New');
+    });
+  });
+
+  describe('api keys', () => {
+    it('stops using a revoked key without changing the config', async () => {
+      const { service, configStore, factory } = setup();
+      const config = configStore.get();
+
+      const failed = collect(await service.createCompletion({ message: PROMPT }));
+      factory.lastStream.emit('error', new APIError(401, undefined, 'Invalid API key', {}));
+      await assert.rejects(failed);
+
+      const completion = collect(await service.createCompletion({ message: PROMPT }));
+      factory.lastStream.respond(['Hello']);
+      await completion;
+
+      assert.deepEqual(
+        factory.clients.map(({ apiKey }) => apiKey),
+        ['sk-ant-first', 'sk-ant-second'],
+      );
+      assert.deepEqual(config.anthropic.apiKeys, ['sk-ant-first', 'sk-ant-second']);
+    });
+  });
+});
@@ -1,30 +1,84 @@
-import { Anthropic, APIError } from '@anthropic-ai/sdk';
+import {
+  APIConnectionError,
+  APIConnectionTimeoutError,
+  APIError,
+  APIUserAbortError,
+} from '@anthropic-ai/sdk';
 import { AnthropicError } from '@anthropic-ai/sdk/error';
-import { MessageParam } from '@anthropic-ai/sdk/resources';
+import { MessageParam, TextBlockParam } from '@anthropic-ai/sdk/resources';
 import { Inject, Injectable, Logger } from '@nestjs/common';
+import { createHash } from 'crypto';
 import { Observable, Subject } from 'rxjs';
 
-import { AppError } from '../../common/errors';
+import { AppError, CompletionTimeoutError, ServiceUnavailableError } from '../../common/errors';
+import { LabeledCounter } from '../../common/metrics';
+import { prefetch, renderTemplate, validateConfig } from '../../utils';
 
+import { AnthropicClient, AnthropicClientFactory } from './anthropic-client.service';
 import { AnthropicUtilsService } from './anthropic-utils.service';
-import { AnthropicConfig } from './anthropic.config';
-import { CompletionMessage } from './dto/common';
+import { AnthropicConfig, AnthropicConfigStore, VerbosityPreset } from './anthropic.config';
+import {
+  CompletionMessage,
+  CompletionPreferences,
+  PromptTemplateData,
+  RenderedTemplateData,
+  TokenEstimate,
+} from './dto/common';
+import { CompletionFailureEnum, StopReasonEnum, VerbosityEnum } from './dto/enum';
 import { CreateCompletionOptionsDto, CreateCompletionResultDto } from './dto/internal';
+import { ImagePreprocessor } from './image-preprocessor.service';
+
+const MAX_CACHED_TOKEN_COUNTS = 1000;
+
+const MAX_CONCURRENT_TOKEN_COUNTS = 4;
+
+const DEFAULT_HISTORY_PREFETCH = 1;
+
+const DEFAULT_AUTH_FAILURE_THRESHOLD = 3;
+
+const DEFAULT_UNAVAILABLE_NOTICE =
+  'Бот временно недоступен из-за проблем с доступом к Anthropic API, попробуй позже';
+
+const DEFAULT_VERBOSITY_PRESETS: Record<VerbosityEnum, VerbosityPreset> = {
+  [VerbosityEnum.CONCISE]: {
+    instruction: 'Keep your answers short and to the point.',
+  },
+  [VerbosityEnum.NORMAL]: {},
+  [VerbosityEnum.DETAILED]: {
+    instruction: 'Give thorough, detailed answers with explanations and examples.',
+  },
+};
 
 @Injectable()
 export class AnthropicService {
   private logger = new Logger(this.constructor.name);
-  private client: Anthropic;
+  private client: AnthropicClient;
+
+  private readonly tokenCounts: Map<string, number> = new Map();
+
+  private readonly failures = new LabeledCounter<CompletionFailureEnum>();
+
+  private authFailures = 0;
+
+  private unavailableSince: Date | null = null;
 
   constructor(
-    @Inject(AnthropicConfig)
-    private config: AnthropicConfig,
+    @Inject(AnthropicConfigStore)
+    private configStore: AnthropicConfigStore,
     @Inject(AnthropicUtilsService)
     private anthropicUtilsService: AnthropicUtilsService,
+    @Inject(ImagePreprocessor)
+    private imagePreprocessor: ImagePreprocessor,
+    @Inject(AnthropicClientFactory)
+    private anthropicClientFactory: AnthropicClientFactory,
   ) {
     this.client = this.createClient();
   }
 
+  private get config(): AnthropicConfig {
+    return this.configStore.get();
+  }
+
   validateAttachment(
     size: number,
     contentType: string = 'application/octet-stream',
@@ -47,21 +101,49 @@ export class AnthropicService {
     return false;
   }
 
+  updateConfig(config: AnthropicConfig): void {
+    validateConfig(AnthropicConfig, config);
+
+    // The providers are resolved once on startup and cannot be swapped by a reload
+    this.configStore.set({
+      ...config,
+      imagePreprocessor: this.config.imagePreprocessor,
+      clientFactory: this.config.clientFactory,
+    });
+
+    this.apiKey = undefined;
+    this.client = this.createClient();
+  }
+
   async createCompletion({
     message,
+    preferences,
     signal,
     getPreviousMessage,
+    systemMessage,
+    context,
+    prefill,
+    templateData,
   }: CreateCompletionOptionsDto): Promise<Observable<CreateCompletionResultDto>> {
-    const messages = await this.prepareMessages(message, getPreviousMessage);
+    const model = preferences?.model ?? this.config.anthropic.model;
+
+    const preparedMessages = await this.prepareMessages(message, model, getPreviousMessage);
+    const data = this.getTemplateData(preparedMessages, templateData);
+    const messages = this.wrapUserMessage(preparedMessages, data);
+
+    // The API rejects a final assistant turn that ends with whitespace
+    if (prefill?.trim()) {
+      messages.push({ role: 'assistant', content: prefill.trimEnd() });
+    }
 
     const stream = this.client.messages.stream(
       {
-        model: this.config.anthropic.model,
-        max_tokens: this.config.anthropic.maxTokens,
+        model,
+        max_tokens: this.getMaxTokens(preferences),
         temperature: this.config.anthropic.temperature,
         top_k: this.config.anthropic.topK,
         top_p: this.config.anthropic.topP,
-        system: this.config.systemMessage,
+        system: this.getSystemMessage(data, preferences, systemMessage, context),
         messages,
       },
       {
@@ -71,21 +153,259 @@ export class AnthropicService {
 
     const subject = new Subject<CreateCompletionResultDto>();
 
+    const idleTimeout = this.config.streamIdleTimeout ?? 60000;
+
+    let idleTimer: NodeJS.Timeout | undefined;
+    let isTimedOut = false;
+
+    const resetIdleTimer = () => {
+      clearTimeout(idleTimer);
+
+      idleTimer = setTimeout(() => {
+        isTimedOut = true;
+
+        this.logger.warn(`No completion events received for ${idleTimeout} ms: aborting...`);
+
+        const error = new CompletionTimeoutError('Anthropic API stream stalled');
+
+        this.recordFailure(error);
+        subject.error(error);
+
+        stream.abort();
+      }, idleTimeout);
+    };
+
+    // Waiting for the response is bounded by the request timeout of the client, the idle timer only
+    // starts once the stream is connected, so that a slow first token is not taken for a stall
+    stream.on('connect', resetIdleTimer);
+    stream.on('streamEvent', resetIdleTimer);
+
     stream.on('text', (chunk) =>
       subject.next({
         chunk,
       }),
     );
 
-    stream.on('end', () => subject.complete());
+    stream.on('finalMessage', (message) => {
+      this.recordSuccess();
+
+      subject.next({
+        chunk: '',
+        stopReason: (message.stop_reason ?? undefined) as StopReasonEnum | undefined,
+        usage: {
+          model: message.model,
+          inputTokens: message.usage.input_tokens,
+          outputTokens: message.usage.output_tokens,
+        },
+      });
+    });
+
+    stream.on('end', () => {
+      clearTimeout(idleTimer);
+      subject.complete();
+    });
+
+    stream.on('abort', (error) => {
+      clearTimeout(idleTimer);
 
-    stream.on('abort', (error) => subject.error(this.handleError(error)));
-    stream.on('error', (error) => subject.error(this.handleError(error)));
+      if (!isTimedOut) {
+        subject.error(this.handleError(error));
+      }
+    });
+
+    stream.on('error', (error) => {
+      clearTimeout(idleTimer);
+      subject.error(this.handleError(error));
+    });
 
     return subject.asObservable();
   }
 
+  async estimateTokens({
+    message,
+    preferences,
+    getPreviousMessage,
+    systemMessage,
+    context,
+    templateData,
+  }: Omit<CreateCompletionOptionsDto, 'signal'>): Promise<TokenEstimate> {
+    const preparedMessages = await this.prepareMessages(
+      message,
+      preferences?.model ?? this.config.anthropic.model,
+      getPreviousMessage,
+    );
+    const data = this.getTemplateData(preparedMessages, templateData);
+    const messages = this.wrapUserMessage(preparedMessages, data);
+
+    return {
+      inputTokens: this.anthropicUtilsService.estimateTokens(
+        messages,
+        this.getSystemMessage(data, preferences, systemMessage, context),
+      ),
+      maxTokens: this.getMaxTokens(preferences),
+      messages: messages.length,
+    };
+  }
+
+  private getVerbosityPreset(preferences?: CompletionPreferences): VerbosityPreset {
+    const verbosity = preferences?.verbosity ?? VerbosityEnum.NORMAL;
+
+    return {
+      ...DEFAULT_VERBOSITY_PRESETS[verbosity],
+      ...this.config.verbosityPresets?.[verbosity],
+    };
+  }
+
+  private getMaxTokens(preferences?: CompletionPreferences): number {
+    return this.getVerbosityPreset(preferences).maxTokens ?? this.config.anthropic.maxTokens;
+  }
+
+  private getSystemMessage(
+    data: RenderedTemplateData,
+    preferences?: CompletionPreferences,
+    systemMessage: string | undefined = this.config.systemMessage,
+    context?: string,
+  ): string | undefined {
+    const instructions = [
+      systemMessage && this.renderTemplate(systemMessage, data),
+      context,
+      this.getVerbosityPreset(preferences).instruction,
+      preferences?.language &&
+        `Always respond in ${preferences.language}, whatever language the messages are written in.`,
+    ];
+
+    return instructions.filter(Boolean).join('\n\n') || undefined;
+  }
+
+  private getTemplateData(
+    messages: MessageParam[],
+    templateData?: PromptTemplateData,
+  ): RenderedTemplateData {
+    return {
+      ...templateData,
+      date: new Date().toISOString().slice(0, 10),
+      history: { length: messages.length - 1 },
+    };
+  }
+
+  private wrapUserMessage(messages: MessageParam[], data: RenderedTemplateData): MessageParam[] {
+    const message = messages.at(-1) as MessageParam;
+
+    if (!this.config.userMessageTemplate || typeof message.content === 'string') {
+      return messages;
+    }
+
+    const index = message.content.findIndex(({ type }) => type === 'text');
+    const text = this.renderTemplate(this.config.userMessageTemplate, {
+      ...data,
+      content: index === -1 ? '' : (message.content[index] as TextBlockParam).text,
+    });
+
+    const content =
+      index === -1
+        ? [{ type: 'text' as const, text }, ...message.content]
+        : message.content.map((block, blockIndex) =>
+            blockIndex === index ? { type: 'text' as const, text } : block,
+          );
+
+    return [...messages.slice(0, -1), { ...message, content }];
+  }
+
+  // Channel prompts are not validated on startup, a broken one is better sent as is than dropped
+  private renderTemplate(template: string, data: RenderedTemplateData): string {
+    try {
+      return renderTemplate(template, data);
+    } catch (error) {
+      this.logger.warn(`Cannot render template, using it as is: ${error}`);
+      return template;
+    }
+  }
+
+  getFailureCounts(): Partial<Record<CompletionFailureEnum, number>> {
+    return this.failures.getAll();
+  }
+
+  // Set after repeated auth failures, requests are still sent so that a reloaded key recovers
+  getUnavailableSince(): Date | null {
+    return this.unavailableSince;
+  }
+
+  private recordSuccess(): void {
+    this.authFailures = 0;
+
+    if (this.unavailableSince) {
+      this.logger.log(
+        `Anthropic API is available again after ${Date.now() - this.unavailableSince.getTime()} ms`,
+      );
+
+      this.unavailableSince = null;
+    }
+  }
+
+  private recordAuthFailure(): void {
+    this.authFailures++;
+
+    const threshold = this.config.authFailureThreshold ?? DEFAULT_AUTH_FAILURE_THRESHOLD;
+
+    // Logged once per outage, every request failing with the same error would bury it
+    if (!this.unavailableSince && this.authFailures >= threshold) {
+      this.unavailableSince = new Date();
+
+      this.logger.error(
+        `Anthropic API rejected the credentials ${this.authFailures} times in a row: ` +
+          'the API keys are likely revoked, replying with the unavailable notice ' +
+          'until a request succeeds',
+      );
+    }
+  }
+
+  private recordFailure(error: unknown): void {
+    // Aborts requested by users are not failures
+    if (error instanceof APIUserAbortError) {
+      return;
+    }
+
+    const failure = this.classifyError(error);
+    const count = this.failures.increment(failure);
+
+    if (failure === CompletionFailureEnum.AUTH) {
+      this.recordAuthFailure();
+    }
+
+    this.logger.warn(`Completion failed: ${failure} (${count} in total)`);
+  }
+
+  private classifyError(error: unknown): CompletionFailureEnum {
+    if (error instanceof CompletionTimeoutError || error instanceof APIConnectionTimeoutError) {
+      return CompletionFailureEnum.TIMEOUT;
+    }
+
+    if (error instanceof APIConnectionError) {
+      return CompletionFailureEnum.NETWORK;
+    }
+
+    if (!(error instanceof APIError) || error.status === undefined) {
+      return CompletionFailureEnum.UNKNOWN;
+    }
+
+    switch (error.status) {
+      case 429:
+        return CompletionFailureEnum.RATE_LIMITED;
+      case 529:
+        return CompletionFailureEnum.OVERLOADED;
+      case 401:
+      case 403:
+        return CompletionFailureEnum.AUTH;
+      default:
+        return error.status >= 500
+          ? CompletionFailureEnum.SERVER
+          : CompletionFailureEnum.BAD_REQUEST;
+    }
+  }
+
   private handleError(error: AnthropicError): AppError {
+    this.recordFailure(error);
+
     if (error instanceof APIError) {
       switch (error.status) {
         case 429: {
@@ -107,81 +427,198 @@ export class AnthropicService {
       this.logger.error(error.message, error.stack ?? error.cause);
     }
 
+    if (this.unavailableSince) {
+      return new ServiceUnavailableError(
+        this.config.unavailableNotice ?? DEFAULT_UNAVAILABLE_NOTICE,
+      );
+    }
+
     return new AppError('Произошла ошибка при запросе к Anthropic API');
   }
 
   private async prepareMessages(
     message: CompletionMessage,
+    model: string,
     getPreviousMessage?: CreateCompletionOptionsDto['getPreviousMessage'],
   ): Promise<MessageParam[]> {
     const result: MessageParam[] = [];
 
-    const parsedMessage = this.anthropicUtilsService.parseMessage(message);
+    // Fetching the history ahead overlaps its downloads with the processing of the messages
+    // already fetched, while the order of the messages stays the same
+    const getPrefetchedMessage = getPreviousMessage
+      ? prefetch(getPreviousMessage, this.config.historyPrefetch ?? DEFAULT_HISTORY_PREFETCH)
+      : null;
+
+    // The sizes of the history messages are counted while the next ones are parsed, a few counts
+    // run at once instead of waiting for each other
+    const getSizedMessage = prefetch(async () => {
+      const previousMessage = await getPrefetchedMessage?.().catch(() => null);
+
+      if (!previousMessage) {
+        return null;
+      }
+
+      const parsedMessage = this.anthropicUtilsService.parseMessage(
+        await this.preprocessMessage(previousMessage),
+      );
+
+      return { parsedMessage, size: this.getContextSize(parsedMessage, model) };
+    }, MAX_CONCURRENT_TOKEN_COUNTS);
+
+    let parsedMessage = this.anthropicUtilsService.parseMessage(
+      await this.preprocessMessage(message),
+    );
+
+    if (this.anthropicUtilsService.getMessageLength(parsedMessage) > this.config.maxContextLength) {
+      this.logger.warn('Message exceeds max context length: truncating...');
+
+      parsedMessage = this.anthropicUtilsService.truncateMessage(
+        parsedMessage,
+        this.config.maxContextLength,
+      );
+    }
+
+    const maxContextSize = this.config.maxContextTokens ?? this.config.maxContextLength;
 
-    const messageLength = this.anthropicUtilsService.getMessageLength(parsedMessage);
+    let contextSize = await this.getContextSize(parsedMessage, model);
 
     while (true) {
-      const previousMessage = await getPreviousMessage?.().catch(() => null);
+      const previousMessage = await getSizedMessage();
 
       if (!previousMessage) {
         break;
       }
 
-      const parsedMessage = this.anthropicUtilsService.parseMessage(previousMessage);
+      const previousMessageSize = await previousMessage.size;
 
-      const previousMessageLength = this.anthropicUtilsService.getMessageLength(parsedMessage);
-
-      if (messageLength + previousMessageLength >= this.config.maxContextLength) {
+      if (contextSize + previousMessageSize >= maxContextSize) {
         break;
       }
 
-      result.unshift(parsedMessage);
+      contextSize += previousMessageSize;
+      result.unshift(previousMessage.parsedMessage);
     }
 
     result.push(parsedMessage);
 
-    while (result[0].role === 'assistant') {
+    while (result.length && result[0].role === 'assistant') {
       result.shift();
     }
 
+    if (this.config.maxImagePayload) {
+      return this.anthropicUtilsService.limitImagePayload(result, this.config.maxImagePayload);
+    }
+
     return result;
   }
 
+  private async getContextSize(message: MessageParam, model: string): Promise<number> {
+    if (!this.config.maxContextTokens) {
+      return this.anthropicUtilsService.getMessageLength(message);
+    }
+
+    const key = createHash('sha256')
+      .update(model)
+      .update(JSON.stringify(message.content))
+      .digest('hex');
+
+    const cachedTokens = this.tokenCounts.get(key);
+
+    if (cachedTokens !== undefined) {
+      return cachedTokens;
+    }
+
+    try {
+      const tokens = await this.client.countTokens({
+        model,
+        messages: [{ role: 'user', content: message.content }],
+      });
+
+      this.tokenCounts.set(key, tokens);
+
+      if (this.tokenCounts.size > MAX_CACHED_TOKEN_COUNTS) {
+        this.tokenCounts.delete(this.tokenCounts.keys().next().value);
+      }
+
+      return tokens;
+    } catch (error) {
+      this.logger.warn(`Cannot count tokens, falling back to an estimate: ${error}`);
+      return this.anthropicUtilsService.estimateTokens([message]);
+    }
+  }
+
+  private async preprocessMessage(message: CompletionMessage): Promise<CompletionMessage> {
+    if (!message.attachments?.length) {
+      return message;
+    }
+
+    return {
+      ...message,
+      attachments: await Promise.all(
+        message.attachments.map(async (attachment) => {
+          if (
+            attachment.contentType?.split('/').at(0) !== 'image' ||
+            this.anthropicUtilsService.isImageTooLarge(attachment)
+          ) {
+            return attachment;
+          }
+
+          const extractedText = await this.imagePreprocessor
+            .process(attachment)
+            .catch((error) => {
+              this.logger.error(error);
+              return null;
+            });
+
+          return extractedText ? { ...attachment, extractedText } : attachment;
+        }),
+      ),
+    };
+  }
+
   private apiKey?: string;
 
-  private createClient(): Anthropic {
-    if (this.config.anthropic.apiKeys.length === 0) {
+  // Keys rejected by the API. They are kept apart from the config, which handlers that captured it
+  // are still reading, and are skipped by every config loaded later
+  private readonly revokedKeys = new Set<string>();
+
+  private get apiKeys(): string[] {
+    return this.config.anthropic.apiKeys.filter((key) => !this.revokedKeys.has(key));
+  }
+
+  private createClient(): AnthropicClient {
+    if (this.apiKeys.length === 0) {
       this.logger.error('Api keys not found');
     }
 
     if (!this.apiKey) {
-      this.apiKey = this.config.anthropic.apiKeys[0];
+      this.apiKey = this.apiKeys[0];
     }
 
-    return new Anthropic({
-      apiKey: `${this.apiKey}`,
-      maxRetries: 10,
-      timeout: 30000,
+    return this.anthropicClientFactory.create(`${this.apiKey}`, {
+      betas: this.config.anthropic.betas,
     });
   }
 
   private removeCurrentKey() {
-    this.config.anthropic.apiKeys = this.config.anthropic.apiKeys.filter(
-      (key) => key !== this.client.apiKey,
-    );
+    this.revokedKeys.add(`${this.client.apiKey}`);
+
+    this.apiKey = undefined;
     this.client = this.createClient();
   }
 
   private swapKey() {
-    if (this.config.anthropic.apiKeys.length === 0) {
+    const apiKeys = this.apiKeys;
+
+    if (apiKeys.length === 0) {
       return;
     }
 
-    const index = this.config.anthropic.apiKeys.indexOf(this.client.apiKey as string);
+    const index = apiKeys.indexOf(this.client.apiKey as string);
     if (index === -1) {
-      this.apiKey = this.config.anthropic.apiKeys[0];
+      this.apiKey = apiKeys[0];
     } else {
-      this.apiKey = this.config.anthropic.apiKeys[index + 1] ?? this.config.anthropic.apiKeys[0];
+      this.apiKey = apiKeys[index + 1] ?? apiKeys[0];
     }
 
     this.client = this.createClient();
@@ -0,0 +1,46 @@
+export const CODE_LANGUAGES_BY_EXTENSION: Record<string, string> = {
+  bash: 'bash',
+  c: 'c',
+  cpp: 'cpp',
+  cs: 'csharp',
+  css: 'css',
+  go: 'go',
+  h: 'c',
+  hpp: 'cpp',
+  html: 'html',
+  java: 'java',
+  js: 'javascript',
+  json: 'json',
+  jsx: 'jsx',
+  kt: 'kotlin',
+  lua: 'lua',
+  md: 'markdown',
+  php: 'php',
+  py: 'python',
+  rb: 'ruby',
+  rs: 'rust',
+  sh: 'bash',
+  sql: 'sql',
+  swift: 'swift',
+  toml: 'toml',
+  ts: 'typescript',
+  tsx: 'tsx',
+  xml: 'xml',
+  yaml: 'yaml',
+  yml: 'yaml',
+};
+
+export const CODE_LANGUAGES_BY_CONTENT_TYPE: Record<string, string> = {
+  'application/javascript': 'javascript',
+  'application/json': 'json',
+  'application/x-sh': 'bash',
+  'application/xml': 'xml',
+  'text/css': 'css',
+  'text/html': 'html',
+  'text/javascript': 'javascript',
+  'text/markdown': 'markdown',
+  'text/x-c': 'c',
+  'text/x-python': 'python',
+  'text/xml': 'xml',
+  'text/yaml': 'yaml',
+};
@@ -4,6 +4,9 @@ export interface CompletionAttachment {
   content: Buffer;
   contentType?: string;
   name?: string;
+  extractedText?: string;
+  // Assumed for text that is neither valid UTF-8 nor starts with a BOM
+  encoding?: string;
 }
 
 export interface CompletionMessage {
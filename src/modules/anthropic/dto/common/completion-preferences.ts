@@ -0,0 +1,7 @@
+import { VerbosityEnum } from '../enum';
+
+export interface CompletionPreferences {
+  model?: string;
+  verbosity?: VerbosityEnum;
+  language?: string;
+}
@@ -1,2 +1,5 @@
 export * from './completion-message';
 export * from './get-previous-message';
+export * from './completion-preferences';
+export * from './token-estimate';
+export * from './prompt-template-data';
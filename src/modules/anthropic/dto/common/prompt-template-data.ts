@@ -0,0 +1,30 @@
+// Data available to the system message and user message templates. The date, the history and,
+// in user message templates, the content of the message are added by AnthropicService
+export interface PromptTemplateData {
+  bot?: {
+    name: string;
+  };
+  user?: {
+    id: string;
+    name: string;
+  };
+  // Absent in DMs
+  guild?: {
+    name: string;
+  };
+  channel?: {
+    name: string;
+  };
+  // The preferred locale of the guild, e.g. en-US
+  locale?: string;
+}
+
+export interface RenderedTemplateData extends PromptTemplateData {
+  // The current UTC date as YYYY-MM-DD
+  date: string;
+  history: {
+    // The number of earlier messages sent along with the prompt
+    length: number;
+  };
+  content?: string;
+}
@@ -0,0 +1,11 @@
+export interface TokenEstimate {
+  inputTokens: number;
+  maxTokens: number;
+  messages: number;
+}
+
+export interface TokenUsage {
+  model: string;
+  inputTokens: number;
+  outputTokens: number;
+}
@@ -0,0 +1,10 @@
+export enum CompletionFailureEnum {
+  RATE_LIMITED = 'rate_limited',
+  OVERLOADED = 'overloaded',
+  AUTH = 'auth',
+  TIMEOUT = 'timeout',
+  BAD_REQUEST = 'bad_request',
+  NETWORK = 'network',
+  SERVER = 'server',
+  UNKNOWN = 'unknown',
+}
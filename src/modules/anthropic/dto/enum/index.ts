@@ -1 +1,4 @@
 export * from './message-role.enum';
+export * from './stop-reason.enum';
+export * from './verbosity.enum';
+export * from './completion-failure.enum';
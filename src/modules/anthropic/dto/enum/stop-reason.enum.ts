@@ -0,0 +1,6 @@
+export enum StopReasonEnum {
+  END_TURN = 'end_turn',
+  MAX_TOKENS = 'max_tokens',
+  STOP_SEQUENCE = 'stop_sequence',
+  REFUSAL = 'refusal',
+}
@@ -0,0 +1,5 @@
+export enum VerbosityEnum {
+  CONCISE = 'concise',
+  NORMAL = 'normal',
+  DETAILED = 'detailed',
+}
@@ -1,10 +1,26 @@
-import { CompletionMessage, GetPreviousMessage } from '../common';
+import {
+  CompletionMessage,
+  CompletionPreferences,
+  GetPreviousMessage,
+  PromptTemplateData,
+  TokenUsage,
+} from '../common';
+import { StopReasonEnum } from '../enum';
 
 export type CreateCompletionOptionsDto = {
+  context?: string;
   getPreviousMessage?: GetPreviousMessage;
   message: CompletionMessage;
+  preferences?: CompletionPreferences;
+  // The beginning of the response, the completion continues it instead of starting over
+  prefill?: string;
   signal?: AbortSignal;
+  systemMessage?: string;
+  templateData?: PromptTemplateData;
 };
 export type CreateCompletionResultDto = {
   chunk: string;
+  stopReason?: StopReasonEnum;
+  // Sent once, along with the stop reason
+  usage?: TokenUsage;
 };
@@ -0,0 +1,14 @@
+import { Injectable } from '@nestjs/common';
+
+import { CompletionAttachment } from './dto/common';
+
+export abstract class ImagePreprocessor {
+  abstract process(attachment: CompletionAttachment): Promise<string | null>;
+}
+
+@Injectable()
+export class NoopImagePreprocessor extends ImagePreprocessor {
+  async process(): Promise<string | null> {
+    return null;
+  }
+}
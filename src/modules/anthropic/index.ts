@@ -1,4 +1,8 @@
+export * from './anthropic-client.service';
+export * from './anthropic-models';
+export * from './anthropic.config';
 export * from './anthropic.module';
 export * from './anthropic.service';
 export * from './dto/common';
 export * from './dto/enum';
+export * from './image-preprocessor.service';
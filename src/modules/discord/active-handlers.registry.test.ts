@@ -0,0 +1,77 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { ActiveHandler, ActiveHandlersRegistry } from './active-handlers.registry';
+
+const createHandler = (messageId: string, authorId: string = 'author'): ActiveHandler => ({
+  messageId,
+  authorId,
+  abortController: new AbortController(),
+  replies: [],
+});
+
+describe('ActiveHandlersRegistry', () => {
+  it('replaces the handler registered for the same message', () => {
+    const registry = new ActiveHandlersRegistry();
+    const first = createHandler('message');
+    const second = createHandler('message');
+
+    registry.register(first);
+    registry.register(second);
+
+    assert.equal(registry.get('message'), second);
+    assert.ok(registry.has('message'));
+    assert.ok(!registry.has('other'));
+  });
+
+  it('finds handlers matching a predicate', () => {
+    const registry = new ActiveHandlersRegistry();
+    const first = createHandler('first', 'alice');
+    const second = createHandler('second', 'bob');
+
+    registry.register(first);
+    registry.register(second);
+
+    assert.deepEqual(registry.find(({ authorId }) => authorId === 'bob'), [second]);
+  });
+
+  it('keeps an aborted handler registered', () => {
+    const registry = new ActiveHandlersRegistry();
+    const handler = createHandler('message');
+
+    registry.register(handler);
+
+    assert.equal(registry.abort('message'), handler);
+    assert.ok(handler.abortController.signal.aborted);
+    assert.equal(registry.get('message'), handler);
+    assert.equal(registry.abort('other'), null);
+  });
+
+  it('removes a cancelled handler', () => {
+    const registry = new ActiveHandlersRegistry();
+    const handler = createHandler('message');
+
+    registry.register(handler);
+
+    assert.equal(registry.cancel('message'), handler);
+    assert.ok(handler.abortController.signal.aborted);
+    assert.ok(!registry.has('message'));
+    assert.equal(registry.cancel('message'), null);
+  });
+
+  it('only completes the handler still registered for its message', () => {
+    const registry = new ActiveHandlersRegistry();
+    const previous = createHandler('message');
+    const current = createHandler('message');
+
+    registry.register(previous);
+    registry.abort('message');
+    registry.register(current);
+
+    assert.equal(registry.complete(previous), false);
+    assert.equal(registry.get('message'), current);
+
+    assert.equal(registry.complete(current), true);
+    assert.ok(!registry.has('message'));
+  });
+});
@@ -0,0 +1,63 @@
+import { Injectable } from '@nestjs/common';
+import { Message } from 'discord.js';
+
+export interface ActiveHandler {
+  // The message or interaction the handler responds to
+  messageId: string;
+  authorId: string;
+  abortController: AbortController;
+  // Replies sent so far, a handler that takes over continues editing them
+  replies: Message[];
+}
+
+// Handlers in flight, keyed by the message or interaction they respond to. Handlers only touch
+// the registry synchronously between awaits, so no locking is needed on the event loop
+@Injectable()
+export class ActiveHandlersRegistry {
+  private readonly handlers: Map<string, ActiveHandler> = new Map();
+
+  // Replaces the handler registered for the same message, if any
+  register(handler: ActiveHandler): void {
+    this.handlers.set(handler.messageId, handler);
+  }
+
+  get(messageId: string): ActiveHandler | undefined {
+    return this.handlers.get(messageId);
+  }
+
+  has(messageId: string): boolean {
+    return this.handlers.has(messageId);
+  }
+
+  find(predicate: (handler: ActiveHandler) => boolean): ActiveHandler[] {
+    return [...this.handlers.values()].filter(predicate);
+  }
+
+  // Aborts the handler but keeps it registered, so that the handler restarting the same message
+  // takes over its replies
+  abort(messageId: string): ActiveHandler | null {
+    const handler = this.handlers.get(messageId);
+
+    handler?.abortController.abort();
+
+    return handler ?? null;
+  }
+
+  cancel(messageId: string): ActiveHandler | null {
+    const handler = this.abort(messageId);
+
+    this.handlers.delete(messageId);
+
+    return handler;
+  }
+
+  // Only removes the handler when it was not replaced by a newer one in the meantime, returns
+  // whether it did
+  complete(handler: ActiveHandler): boolean {
+    if (this.handlers.get(handler.messageId) !== handler) {
+      return false;
+    }
+
+    return this.handlers.delete(handler.messageId);
+  }
+}
@@ -0,0 +1,113 @@
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import { Message, TextBasedChannel } from 'discord.js';
+
+import { Cache } from '../../common/cache';
+import { splitText } from '../../utils';
+
+import { DiscordUtilsService } from './discord-utils.service';
+
+const SYSTEM_MESSAGE_PREFIX = '[system]';
+
+const MAX_CHANNEL_TOPIC_LENGTH = 300;
+
+@Injectable()
+export class ChannelPromptService {
+  private readonly logger = new Logger(ChannelPromptService.name);
+
+  private readonly pendingSystemMessages: Map<string, Promise<string | null>> = new Map();
+
+  constructor(
+    @Inject(DiscordUtilsService)
+    private discordUtilsService: DiscordUtilsService,
+    // Channels without a pinned prompt are cached as an empty string
+    @Inject(Cache)
+    private systemMessages: Cache<string>,
+  ) {}
+
+  async getSystemMessage(message: Message): Promise<string | undefined> {
+    const systemMessage =
+      (await this.systemMessages.get(message.channelId)) ??
+      (await this.loadSystemMessage(message.channel));
+
+    return systemMessage || this.discordUtilsService.getGuildConfig(message.guildId).systemMessage;
+  }
+
+  // Read from the cached channel on every call, which discord.js keeps current on channel updates
+  getChannelContext(message: Message): string | undefined {
+    const { channel } = message;
+
+    if (
+      !this.discordUtilsService.getGuildConfig(message.guildId).channelContext ||
+      channel.isDMBased()
+    ) {
+      return undefined;
+    }
+
+    const parent = channel.isThread() ? channel.parent : null;
+    const name = parent ? `#${parent.name} › ${channel.name}` : `#${channel.name}`;
+
+    // Threads have no topic of their own, so they inherit the one of their parent channel
+    const topicChannel = parent ?? channel;
+    const topic = 'topic' in topicChannel ? topicChannel.topic : null;
+
+    const context = [`This conversation takes place in the Discord channel ${name}.`];
+
+    if (topic) {
+      context.push(
+        `Channel topic: ${
+          topic.length > MAX_CHANNEL_TOPIC_LENGTH
+            ? `${splitText(topic, MAX_CHANNEL_TOPIC_LENGTH)[0]}…`
+            : topic
+        }`,
+      );
+    }
+
+    return context.join('\n');
+  }
+
+  isSystemMessage(content: string | null): boolean {
+    return !!content?.startsWith(SYSTEM_MESSAGE_PREFIX);
+  }
+
+  invalidate(channelId: string): void {
+    this.pendingSystemMessages.delete(channelId);
+    this.systemMessages.delete(channelId).catch((error) => this.logger.error(error));
+  }
+
+  private async loadSystemMessage(channel: TextBasedChannel): Promise<string | null> {
+    const pending = this.pendingSystemMessages.get(channel.id);
+
+    if (pending) {
+      return await pending;
+    }
+
+    const fetching = this.fetchSystemMessage(channel);
+    this.pendingSystemMessages.set(channel.id, fetching);
+
+    const systemMessage = await fetching;
+
+    // Do not cache a prompt that was invalidated while it was being fetched
+    if (this.pendingSystemMessages.get(channel.id) === fetching) {
+      this.pendingSystemMessages.delete(channel.id);
+
+      if (systemMessage !== null) {
+        await this.systemMessages.set(channel.id, systemMessage);
+      }
+    }
+
+    return systemMessage;
+  }
+
+  private async fetchSystemMessage(channel: TextBasedChannel): Promise<string | null> {
+    try {
+      const pinned = await channel.messages.fetchPinned();
+
+      const message = [...pinned.values()].find(({ content }) => this.isSystemMessage(content));
+
+      return message?.content.slice(SYSTEM_MESSAGE_PREFIX.length).trim() ?? '';
+    } catch (error) {
+      this.logger.warn(`Cannot fetch pinned messages in channel ${channel.id}: ${error}`);
+      return null;
+    }
+  }
+}
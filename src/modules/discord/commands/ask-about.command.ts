@@ -0,0 +1,51 @@
+import { Command, Handler, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import { ApplicationCommandType, MessageContextMenuCommandInteraction } from 'discord.js';
+
+import { splitText } from '../../../utils';
+import { DiscordService } from '../discord.service';
+
+@Command({
+  name: 'Спросить о сообщении',
+  type: ApplicationCommandType.Message,
+})
+@Injectable()
+export class AskAboutCommand {
+  private readonly logger = new Logger(AskAboutCommand.name);
+
+  constructor(
+    @Inject(DiscordService)
+    private discordService: DiscordService,
+  ) {}
+
+  @Handler()
+  async onAskAbout(
+    @InteractionEvent() interaction: MessageContextMenuCommandInteraction,
+  ): Promise<void> {
+    await interaction.deferReply();
+
+    try {
+      await this.discordService.askAboutMessage(
+        interaction.targetMessage,
+        interaction.user,
+        async (content, isFinal) => {
+          const [first, ...rest] = splitText(content, 2000);
+
+          await interaction.editReply({ content: first, allowedMentions: { parse: [] } });
+
+          if (isFinal) {
+            for (const chunk of rest) {
+              await interaction.followUp({ content: chunk, allowedMentions: { parse: [] } });
+            }
+          }
+        },
+      );
+    } catch (error) {
+      this.logger.error(error);
+
+      await interaction
+        .editReply('Что-то я затупил, может быть пора отдохнуть 😞')
+        .catch((error) => this.logger.error(error));
+    }
+  }
+}
@@ -0,0 +1,77 @@
+import { SlashCommandPipe } from '@discord-nestjs/common';
+import { Command, Handler, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import { ChatInputCommandInteraction } from 'discord.js';
+
+import { DiscordUtilsService } from '../discord-utils.service';
+import { DiscordService } from '../discord.service';
+import { ExportCommandDto } from '../dto/commands';
+
+@Command({
+  name: 'export',
+  description: 'Экспортировать разговор в Markdown',
+})
+@Injectable()
+export class ExportCommand {
+  private readonly logger = new Logger(ExportCommand.name);
+
+  constructor(
+    @Inject(DiscordUtilsService)
+    private discordUtilsService: DiscordUtilsService,
+    @Inject(DiscordService)
+    private discordService: DiscordService,
+  ) {}
+
+  @Handler()
+  async onExport(
+    @InteractionEvent(SlashCommandPipe) dto: ExportCommandDto,
+    @InteractionEvent() interaction: ChatInputCommandInteraction,
+  ): Promise<void> {
+    const message = await this.discordUtilsService.fetchChannelMessage(
+      interaction.channel,
+      dto.message,
+    );
+
+    if (!message) {
+      await interaction.reply({
+        content: 'Сообщение не найдено в этом канале',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    await interaction.deferReply({ ephemeral: true });
+
+    try {
+      const markdown = await this.discordService.exportConversation(message, interaction.user.id);
+
+      if (!markdown) {
+        await interaction.editReply(
+          'Экспортировать можно только разговор, в котором ты участвовал',
+        );
+        return;
+      }
+
+      const file = await this.discordUtilsService.createTextAttachment(
+        markdown,
+        `conversation-${message.id}.md`,
+      );
+
+      // Closed DMs are common, the ephemeral reply is visible to the user alone anyway
+      const isSent = await interaction.user
+        .send({ files: [file] })
+        .then(() => true)
+        .catch(() => false);
+
+      await interaction.editReply(
+        isSent
+          ? { content: 'Разговор отправлен в личные сообщения' }
+          : { content: 'Не удалось написать в личные сообщения, вот файл:', files: [file] },
+      );
+    } catch (error) {
+      this.logger.error(error);
+
+      await interaction.editReply('Не удалось экспортировать разговор');
+    }
+  }
+}
@@ -0,0 +1,51 @@
+import { SlashCommandPipe } from '@discord-nestjs/common';
+import { Command, Handler, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable } from '@nestjs/common';
+import { ChatInputCommandInteraction } from 'discord.js';
+
+import { DiscordConfig, DiscordConfigStore } from '../discord.config';
+import { FeatureCommandDto } from '../dto/commands';
+import { FeatureFlagsService } from '../feature-flags.service';
+
+@Command({
+  name: 'feature',
+  description: 'Управление экспериментальными функциями',
+})
+@Injectable()
+export class FeatureCommand {
+  constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+    @Inject(FeatureFlagsService)
+    private featureFlagsService: FeatureFlagsService,
+  ) {}
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  @Handler()
+  async onFeature(
+    @InteractionEvent(SlashCommandPipe) dto: FeatureCommandDto,
+    @InteractionEvent() interaction: ChatInputCommandInteraction,
+  ): Promise<void> {
+    if (!this.config.adminIds?.includes(interaction.user.id)) {
+      await interaction.reply({
+        content: 'Недостаточно прав',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    if (dto.flag && dto.enabled !== undefined) {
+      this.featureFlagsService.setEnabled(dto.flag, dto.enabled);
+    }
+
+    await interaction.reply({
+      content: Object.entries(this.featureFlagsService.getFlags())
+        .map(([flag, enabled]) => `${enabled ? '✅' : '❌'} ${flag}`)
+        .join('\n'),
+      ephemeral: true,
+    });
+  }
+}
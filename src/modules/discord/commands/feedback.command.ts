@@ -0,0 +1,64 @@
+import { SlashCommandPipe } from '@discord-nestjs/common';
+import { Command, Handler, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable } from '@nestjs/common';
+import { ChatInputCommandInteraction, Message } from 'discord.js';
+
+import { DiscordUtilsService } from '../discord-utils.service';
+import { FeedbackCommandDto } from '../dto/commands';
+import { FeedbackStore } from '../feedback.store';
+
+const LAST_REPLY_LOOKBACK = 50;
+
+@Command({
+  name: 'feedback',
+  description: 'Оставить отзыв об ответе бота',
+})
+@Injectable()
+export class FeedbackCommand {
+  constructor(
+    @Inject(DiscordUtilsService)
+    private discordUtilsService: DiscordUtilsService,
+    @Inject(FeedbackStore)
+    private feedbackStore: FeedbackStore,
+  ) {}
+
+  @Handler()
+  async onFeedback(
+    @InteractionEvent(SlashCommandPipe) dto: FeedbackCommandDto,
+    @InteractionEvent() interaction: ChatInputCommandInteraction,
+  ): Promise<void> {
+    const reply = dto.message
+      ? await this.discordUtilsService.fetchChannelMessage(interaction.channel, dto.message)
+      : await this.fetchLastReply(interaction);
+
+    if (dto.message && reply?.author.id !== interaction.client.user.id) {
+      await interaction.reply({
+        content: 'Ответ бота не найден в этом канале',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    await this.feedbackStore.addNote({
+      replyId: reply?.id ?? null,
+      channelId: interaction.channelId,
+      userId: interaction.user.id,
+      text: dto.text,
+      createdAt: new Date(),
+    });
+
+    await interaction.reply({
+      content: 'Спасибо за отзыв!',
+      ephemeral: true,
+    });
+  }
+
+  private async fetchLastReply(interaction: ChatInputCommandInteraction): Promise<Message | null> {
+    const messages = await interaction.channel?.messages
+      .fetch({ limit: LAST_REPLY_LOOKBACK })
+      .catch(() => null);
+
+    // Fetched messages are ordered from the newest to the oldest
+    return messages?.find((message) => message.author.id === interaction.client.user.id) ?? null;
+  }
+}
@@ -0,0 +1,9 @@
+export * from './ask-about.command';
+export * from './export.command';
+export * from './feature.command';
+export * from './feedback.command';
+export * from './maintenance.command';
+export * from './prefs.command';
+export * from './reload.command';
+export * from './replay.command';
+export * from './tokens.command';
@@ -0,0 +1,51 @@
+import { SlashCommandPipe } from '@discord-nestjs/common';
+import { Command, Handler, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable } from '@nestjs/common';
+import { ChatInputCommandInteraction } from 'discord.js';
+
+import { DiscordConfig, DiscordConfigStore } from '../discord.config';
+import { DiscordService } from '../discord.service';
+import { MaintenanceCommandDto } from '../dto/commands';
+
+@Command({
+  name: 'maintenance',
+  description: 'Режим технических работ',
+})
+@Injectable()
+export class MaintenanceCommand {
+  constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+    @Inject(DiscordService)
+    private discordService: DiscordService,
+  ) {}
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  @Handler()
+  async onMaintenance(
+    @InteractionEvent(SlashCommandPipe) dto: MaintenanceCommandDto,
+    @InteractionEvent() interaction: ChatInputCommandInteraction,
+  ): Promise<void> {
+    if (!this.config.adminIds?.includes(interaction.user.id)) {
+      await interaction.reply({
+        content: 'Недостаточно прав',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    if (dto.enabled !== undefined) {
+      this.discordService.setMaintenance(dto.enabled);
+    }
+
+    await interaction.reply({
+      content: this.discordService.isMaintenance()
+        ? '🛠 Режим технических работ включён'
+        : '✅ Режим технических работ выключен',
+      ephemeral: true,
+    });
+  }
+}
@@ -0,0 +1,63 @@
+import { SlashCommandPipe } from '@discord-nestjs/common';
+import { Command, Handler, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable } from '@nestjs/common';
+import { ChatInputCommandInteraction } from 'discord.js';
+
+import { DiscordUtilsService } from '../discord-utils.service';
+import { PrefsCommandDto } from '../dto/commands';
+import { UserPrefs, UserPrefsStore } from '../user-prefs.store';
+
+@Command({
+  name: 'prefs',
+  description: 'Личные настройки ответов бота',
+})
+@Injectable()
+export class PrefsCommand {
+  constructor(
+    @Inject(DiscordUtilsService)
+    private discordUtilsService: DiscordUtilsService,
+    @Inject(UserPrefsStore)
+    private userPrefsStore: UserPrefsStore,
+  ) {}
+
+  @Handler()
+  async onPrefs(
+    @InteractionEvent(SlashCommandPipe) dto: PrefsCommandDto,
+    @InteractionEvent() interaction: ChatInputCommandInteraction,
+  ): Promise<void> {
+    const models = this.discordUtilsService.getAllowedModels(interaction.guildId);
+
+    if (dto.model && !models.includes(dto.model)) {
+      await interaction.reply({
+        content: `Модель недоступна. Доступные: ${models.join(', ')}`,
+        ephemeral: true,
+      });
+      return;
+    }
+
+    const prefs: UserPrefs = dto.reset ? {} : await this.userPrefsStore.get(interaction.user.id);
+
+    if (dto.model) {
+      prefs.model = dto.model;
+    }
+
+    if (dto.verbosity) {
+      prefs.verbosity = dto.verbosity;
+    }
+
+    if (dto.language) {
+      prefs.language = dto.language;
+    }
+
+    await this.userPrefsStore.set(interaction.user.id, prefs);
+
+    await interaction.reply({
+      content: [
+        `Модель: ${prefs.model ?? 'по умолчанию'}`,
+        `Подробность: ${prefs.verbosity ?? 'по умолчанию'}`,
+        `Язык: ${prefs.language ?? 'по умолчанию'}`,
+      ].join('\n'),
+      ephemeral: true,
+    });
+  }
+}
@@ -0,0 +1,66 @@
+import { Command, Handler, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import { ChatInputCommandInteraction } from 'discord.js';
+
+import { loadAnthropicConfig, loadConfigFile, loadDiscordConfig, reloadEnv } from '../../../config';
+import { validateConfig } from '../../../utils';
+import { AnthropicService } from '../../anthropic';
+import { DiscordConfig, DiscordConfigStore } from '../discord.config';
+
+@Command({
+  name: 'reload',
+  description: 'Перезагрузить конфигурацию без перезапуска',
+})
+@Injectable()
+export class ReloadCommand {
+  private readonly logger = new Logger(ReloadCommand.name);
+
+  constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+    @Inject(AnthropicService)
+    private anthropicService: AnthropicService,
+  ) {}
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  @Handler()
+  async onReload(@InteractionEvent() interaction: ChatInputCommandInteraction): Promise<void> {
+    if (!this.config.adminIds?.includes(interaction.user.id)) {
+      await interaction.reply({
+        content: 'Недостаточно прав',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    try {
+      reloadEnv();
+
+      const configFile = loadConfigFile();
+      const discordConfig = validateConfig(DiscordConfig, loadDiscordConfig(configFile));
+
+      // Validate both configs before swapping so a broken .env leaves the old one in place.
+      // Handlers in flight keep the config objects they started with
+      this.anthropicService.updateConfig(loadAnthropicConfig(configFile));
+      this.configStore.set({ ...discordConfig, botToken: this.config.botToken });
+    } catch (error) {
+      this.logger.error(error);
+
+      await interaction.reply({
+        content: `Не удалось перезагрузить конфигурацию:\n${error}`,
+        ephemeral: true,
+      });
+      return;
+    }
+
+    this.logger.log(`Configuration reloaded by user ${interaction.user.id}`);
+
+    await interaction.reply({
+      content: 'Конфигурация перезагружена',
+      ephemeral: true,
+    });
+  }
+}
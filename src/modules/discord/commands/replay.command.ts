@@ -0,0 +1,89 @@
+import { SlashCommandPipe } from '@discord-nestjs/common';
+import { Command, Handler, InjectDiscordClient, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import { ChatInputCommandInteraction, Client } from 'discord.js';
+
+import { splitText } from '../../../utils';
+import { DiscordUtilsService } from '../discord-utils.service';
+import { DiscordConfig, DiscordConfigStore } from '../discord.config';
+import { DiscordService } from '../discord.service';
+import { ReplayCommandDto } from '../dto/commands';
+
+@Command({
+  name: 'replay',
+  description: 'Перезапустить разговор с текущими настройками в отладочном канале',
+})
+@Injectable()
+export class ReplayCommand {
+  private readonly logger = new Logger(ReplayCommand.name);
+
+  constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+    @Inject(DiscordUtilsService)
+    private discordUtilsService: DiscordUtilsService,
+    @Inject(DiscordService)
+    private discordService: DiscordService,
+    @InjectDiscordClient()
+    private readonly client: Client,
+  ) {}
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  @Handler()
+  async onReplay(
+    @InteractionEvent(SlashCommandPipe) dto: ReplayCommandDto,
+    @InteractionEvent() interaction: ChatInputCommandInteraction,
+  ): Promise<void> {
+    if (!this.config.adminIds?.includes(interaction.user.id)) {
+      await interaction.reply({
+        content: 'Недостаточно прав',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    const debugChannel = this.config.debugChannelId
+      ? await this.client.channels.fetch(this.config.debugChannelId).catch(() => null)
+      : null;
+
+    if (!debugChannel?.isTextBased()) {
+      await interaction.reply({
+        content: 'Отладочный канал не настроен',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    const message = await this.discordUtilsService.fetchChannelMessage(
+      interaction.channel,
+      dto.message,
+    );
+
+    if (!message) {
+      await interaction.reply({
+        content: 'Сообщение не найдено в этом канале',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    await interaction.deferReply({ ephemeral: true });
+
+    try {
+      const content = await this.discordService.replayMessage(message);
+
+      for (const chunk of splitText(`Replay of ${message.url}\n\n${content}`, 2000)) {
+        await debugChannel.send({ content: chunk, allowedMentions: { parse: [] } });
+      }
+
+      await interaction.editReply(`Результат отправлен в ${debugChannel}`);
+    } catch (error) {
+      this.logger.error(error);
+
+      await interaction.editReply('Не удалось перезапустить разговор');
+    }
+  }
+}
@@ -0,0 +1,61 @@
+import { SlashCommandPipe } from '@discord-nestjs/common';
+import { Command, Handler, InteractionEvent } from '@discord-nestjs/core';
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import { ChatInputCommandInteraction } from 'discord.js';
+
+import { DiscordUtilsService } from '../discord-utils.service';
+import { DiscordService } from '../discord.service';
+import { TokensCommandDto } from '../dto/commands';
+
+@Command({
+  name: 'tokens',
+  description: 'Оценить количество токенов в запросе без отправки',
+})
+@Injectable()
+export class TokensCommand {
+  private readonly logger = new Logger(TokensCommand.name);
+
+  constructor(
+    @Inject(DiscordUtilsService)
+    private discordUtilsService: DiscordUtilsService,
+    @Inject(DiscordService)
+    private discordService: DiscordService,
+  ) {}
+
+  @Handler()
+  async onTokens(
+    @InteractionEvent(SlashCommandPipe) dto: TokensCommandDto,
+    @InteractionEvent() interaction: ChatInputCommandInteraction,
+  ): Promise<void> {
+    const message = await this.discordUtilsService.fetchChannelMessage(
+      interaction.channel,
+      dto.message,
+    );
+
+    if (!message) {
+      await interaction.reply({
+        content: 'Сообщение не найдено в этом канале',
+        ephemeral: true,
+      });
+      return;
+    }
+
+    await interaction.deferReply({ ephemeral: true });
+
+    try {
+      const estimate = await this.discordService.estimateTokens(message);
+
+      await interaction.editReply(
+        [
+          `Сообщений в контексте: ${estimate.messages}`,
+          `Входные токены: ~${estimate.inputTokens}`,
+          `Максимум токенов на ответ: ${estimate.maxTokens}`,
+        ].join('\n'),
+      );
+    } catch (error) {
+      this.logger.error(error);
+
+      await interaction.editReply('Не удалось оценить запрос');
+    }
+  }
+}
@@ -0,0 +1,105 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { createClient } from '../../testing/fake-discord';
+import { sleep } from '../../utils';
+
+import { DiscordRateLimitService } from './discord-rate-limit.service';
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
+
+const CHANNEL_ID = '300000000000000001';
+
+const OTHER_CHANNEL_ID = '300000000000000002';
+
+const setup = (config: Partial<DiscordConfig> = {}) => {
+  const fake = createClient();
+  const service = new DiscordRateLimitService(
+    new DiscordConfigStore({ botToken: 'token', ...config }),
+    fake.client,
+  );
+
+  // A response to an edit in the channel, with the rate limit headers Discord returns
+  const respond = (remaining: number, resetAfter: number, channelId: string = CHANNEL_ID) =>
+    fake.rest.emit(
+      'response',
+      { path: `/channels/${channelId}/messages/400000000000000001` },
+      {
+        headers: new Headers({
+          'x-ratelimit-remaining': `${remaining}`,
+          'x-ratelimit-reset-after': `${resetAfter}`,
+        }),
+      },
+    );
+
+  return { service, fake, respond };
+};
+
+describe('DiscordRateLimitService', () => {
+  it('uses the minimal interval without rate limit headers', () => {
+    const { service } = setup({ minEditInterval: 300 });
+
+    assert.equal(service.getEditInterval(CHANNEL_ID), 300);
+  });
+
+  it('spreads the remaining edits over the reset window', () => {
+    const { service, respond } = setup();
+
+    respond(4, 5);
+    assert.equal(service.getEditInterval(CHANNEL_ID), 1000);
+
+    respond(1, 5);
+    assert.equal(service.getEditInterval(CHANNEL_ID), 2500);
+
+    respond(0, 4);
+    assert.equal(service.getEditInterval(CHANNEL_ID), 4000);
+  });
+
+  it('speeds up again once there is headroom', () => {
+    const { service, respond } = setup();
+
+    respond(0, 4);
+    respond(9, 1);
+
+    assert.equal(service.getEditInterval(CHANNEL_ID), 100);
+  });
+
+  it('never goes below the minimal interval nor above the maximal one', () => {
+    const { service, respond } = setup({ minEditInterval: 300 });
+
+    respond(99, 1);
+    assert.equal(service.getEditInterval(CHANNEL_ID), 300);
+
+    respond(0, 60);
+    assert.equal(service.getEditInterval(CHANNEL_ID), 5000);
+  });
+
+  it('backs off when a request is rate limited', () => {
+    const { service, fake, respond } = setup();
+
+    respond(4, 5);
+    fake.rest.emit('rateLimited', {
+      url: `https://discord.com/api/v10/channels/${CHANNEL_ID}/messages/400000000000000001`,
+      timeToReset: 1500,
+    });
+
+    assert.equal(service.getEditInterval(CHANNEL_ID), 2000);
+  });
+
+  it('keeps the cadence of every channel apart', () => {
+    const { service, respond } = setup();
+
+    respond(0, 4);
+
+    assert.equal(service.getEditInterval(OTHER_CHANNEL_ID), 0);
+  });
+
+  it('forgets the rate limit once it resets', async () => {
+    const { service, respond } = setup();
+
+    respond(0, 0.02);
+    assert.equal(service.getEditInterval(CHANNEL_ID), 20);
+
+    await sleep(30);
+    assert.equal(service.getEditInterval(CHANNEL_ID), 0);
+  });
+});
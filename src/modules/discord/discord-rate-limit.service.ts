@@ -0,0 +1,80 @@
+import { InjectDiscordClient } from '@discord-nestjs/core';
+import { Inject, Injectable } from '@nestjs/common';
+import { Client } from 'discord.js';
+
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
+
+const MAX_EDIT_INTERVAL = 5000;
+
+interface ChannelRateLimit {
+  delay: number;
+  expiresAt: number;
+}
+
+@Injectable()
+export class DiscordRateLimitService {
+  private readonly rateLimits: Map<string, ChannelRateLimit> = new Map();
+
+  constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+    @InjectDiscordClient()
+    private readonly client: Client,
+  ) {
+    this.client.rest.on('response', (request, response) => {
+      const channelId = this.getChannelId(request.path);
+
+      const remaining = Number(response.headers.get('x-ratelimit-remaining'));
+      const resetAfter = Number(response.headers.get('x-ratelimit-reset-after')) * 1000;
+
+      if (!channelId || !Number.isFinite(remaining) || !Number.isFinite(resetAfter)) {
+        return;
+      }
+
+      const delay = remaining > 0 ? resetAfter / (remaining + 1) : resetAfter;
+
+      this.setDelay(channelId, delay, resetAfter);
+    });
+
+    this.client.rest.on('rateLimited', (rateLimit) => {
+      const channelId = this.getChannelId(rateLimit.url);
+
+      if (!channelId) {
+        return;
+      }
+
+      this.setDelay(
+        channelId,
+        Math.max(this.getEditInterval(channelId) * 2, rateLimit.timeToReset),
+        rateLimit.timeToReset,
+      );
+    });
+  }
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  getEditInterval(channelId: string): number {
+    const rateLimit = this.rateLimits.get(channelId);
+    const minInterval = this.config.minEditInterval ?? 0;
+
+    if (!rateLimit || rateLimit.expiresAt <= Date.now()) {
+      this.rateLimits.delete(channelId);
+      return minInterval;
+    }
+
+    return Math.max(minInterval, rateLimit.delay);
+  }
+
+  private setDelay(channelId: string, delay: number, resetAfter: number): void {
+    this.rateLimits.set(channelId, {
+      delay: Math.min(delay, MAX_EDIT_INTERVAL),
+      expiresAt: Date.now() + resetAfter,
+    });
+  }
+
+  private getChannelId(path: string): string | null {
+    return path.match(/\/channels\/(\d+)\/messages/)?.[1] ?? null;
+  }
+}
@@ -0,0 +1,69 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { createClient, createMessage, FakeChannel, getOptions } from '../../testing/fake-discord';
+
+import { DiscordUtilsService } from './discord-utils.service';
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
+
+const GUILD_ID = '200000000000000001';
+
+const OTHER_GUILD_ID = '200000000000000002';
+
+const setup = (config: Partial<DiscordConfig> = {}) => {
+  const fake = createClient();
+  const configStore = new DiscordConfigStore({ botToken: 'token', ...config });
+
+  return {
+    service: new DiscordUtilsService(configStore, fake.client),
+    configStore,
+    channel: new FakeChannel(fake, undefined, GUILD_ID),
+  };
+};
+
+describe('DiscordUtilsService', () => {
+  describe('getAllowedMentions', () => {
+    it('pings the author and mentioned users by default', () => {
+      const { service } = setup();
+
+      assert.deepEqual(service.getAllowedMentions(GUILD_ID), {
+        parse: ['users'],
+        repliedUser: true,
+      });
+    });
+
+    it('follows the global config', () => {
+      const { service } = setup({ replyMention: false, allowMentions: false });
+
+      assert.deepEqual(service.getAllowedMentions(null), { parse: [], repliedUser: false });
+    });
+
+    it('lets a guild override the global config', () => {
+      const { service } = setup({
+        replyMention: false,
+        guilds: { [GUILD_ID]: { replyMention: true } },
+      });
+
+      assert.equal(service.getAllowedMentions(GUILD_ID).repliedUser, true);
+      assert.equal(service.getAllowedMentions(OTHER_GUILD_ID).repliedUser, false);
+    });
+  });
+
+  describe('editOrReplyMessage', () => {
+    it('sends every message of a long reply with the allowed mentions', async () => {
+      const { service, channel } = setup({ replyMention: false });
+      const message = createMessage(channel, { content: 'Расскажи подробно' });
+
+      const replies = await service.editOrReplyMessage(message, 'Абзац.\n\n'.repeat(400));
+
+      assert.equal(replies.length, 2);
+
+      for (const reply of replies) {
+        assert.deepEqual(getOptions(reply).allowedMentions, {
+          parse: ['users'],
+          repliedUser: false,
+        });
+      }
+    });
+  });
+});
@@ -1,46 +1,396 @@
-import { Injectable } from '@nestjs/common';
-import { AttachmentBuilder, BaseMessageOptions, Message, TextBasedChannel } from 'discord.js';
+import { InjectDiscordClient } from '@discord-nestjs/core';
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import {
+  AttachmentBuilder,
+  BaseMessageOptions,
+  Client,
+  DiscordAPIError,
+  EmbedBuilder,
+  Message,
+  MessageMentionOptions,
+  RESTJSONErrorCodes,
+  TextBasedChannel,
+} from 'discord.js';
+
+import { splitText, truncateText } from '../../utils';
+import { ANTHROPIC_MODELS } from '../anthropic';
+
+import { DiscordConfig, DiscordConfigStore, DiscordGuildConfig } from './discord.config';
+import { ResponseFormatEnum } from './dto/enum';
+
+const FILE_SUMMARY_LENGTH = 300;
+
+const DEFAULT_PROMPT_DISPLAY_LENGTH = 256;
+
+const MAX_EMBED_TITLE_LENGTH = 256;
+
+const PROMPT_QUOTE_LENGTH = 100;
+
+const CONTINUATION_NOTE = '\n\n📎 Продолжение во вложении';
 
 @Injectable()
 export class DiscordUtilsService {
+  private readonly logger = new Logger(DiscordUtilsService.name);
+
+  constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+    @InjectDiscordClient()
+    private readonly client: Client,
+  ) {}
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  getGuildConfig(guildId: string | null, config: DiscordConfig = this.config): DiscordGuildConfig {
+    return {
+      ...config,
+      ...(guildId ? config.guilds?.[guildId] : undefined),
+    };
+  }
+
+  getAllowedMentions(
+    guildId: string | null,
+    config: DiscordConfig = this.config,
+  ): MessageMentionOptions {
+    const { replyMention = true, allowMentions = true } = this.getGuildConfig(guildId, config);
+
+    return {
+      parse: allowMentions ? ['users'] : [],
+      repliedUser: replyMention,
+    };
+  }
+
+  getAllowedModels(guildId: string | null): string[] {
+    return this.getGuildConfig(guildId).models ?? ANTHROPIC_MODELS;
+  }
+
+  getDisplayPrompt(
+    message: Message,
+    maxLength: number = Infinity,
+    config: DiscordConfig = this.config,
+  ): string {
+    return truncateText(
+      message.cleanContent,
+      Math.min(config.promptDisplayLength ?? DEFAULT_PROMPT_DISPLAY_LENGTH, maxLength),
+    );
+  }
+
+  async fetchReference(message: Message): Promise<Message | null> {
+    if (!message.reference?.messageId) {
+      return null;
+    }
+
+    try {
+      const channel = await this.client.channels.fetch(message.reference.channelId);
+
+      if (!channel?.isTextBased()) {
+        return null;
+      }
+
+      return await channel.messages.fetch(message.reference.messageId);
+    } catch (error) {
+      this.logger.warn(
+        `Cannot fetch referenced message ${message.reference.messageId} in channel ${message.reference.channelId}: ${error}`,
+      );
+      return null;
+    }
+  }
+
+  async fetchChannelMessage(
+    channel: TextBasedChannel | null,
+    reference: string,
+  ): Promise<Message | null> {
+    const messageId = reference.trim().match(/\d{17,20}$/)?.[0];
+
+    if (!channel || !messageId) {
+      return null;
+    }
+
+    return await channel.messages.fetch(messageId).catch(() => null);
+  }
+
   async createTextAttachment(content: string, name: string): Promise<AttachmentBuilder> {
     const attachment = new AttachmentBuilder(Buffer.from(content));
     attachment.setName(name);
     return attachment;
   }
 
-  sendTyping(channel: TextBasedChannel): () => void {
+  sendTyping(channel: TextBasedChannel, signal?: AbortSignal): () => void {
+    if (signal?.aborted) {
+      return () => {};
+    }
+
     channel.sendTyping().catch(() => null);
     const interval = setInterval(() => {
       channel.sendTyping().catch(() => null);
     }, 10000);
 
-    return () => clearInterval(interval);
+    const stop = () => {
+      clearInterval(interval);
+      signal?.removeEventListener('abort', stop);
+    };
+
+    signal?.addEventListener('abort', stop);
+
+    return stop;
   }
 
+  // A handler passes the config it started with, so that a reload does not change its reply
+  // halfway through
   async editOrReplyMessage(
     message: Message,
     content: string,
-    reply?: Message,
-  ): Promise<Message | null> {
-    const payload: BaseMessageOptions =
-      content.length > 2000
-        ? {
-            files: [await this.createTextAttachment(content, 'message.txt')],
-            content: '',
-          }
-        : {
-            content,
-          };
+    replies: Message[] = [],
+    isPreview: boolean = false,
+    config: DiscordConfig = this.config,
+  ): Promise<Message[]> {
+    if (!content) {
+      return replies;
+    }
+
+    const payloads = await this.createPayloads(message, content, isPreview, config);
+    const result: Message[] = [];
 
-    if (content) {
-      if (reply) {
-        return await reply.edit(payload);
+    const previewLength = config.longFormPreview
+      ? (config.maxReplyMessages ?? payloads.length)
+      : 1;
+
+    const sentPayloads = isPreview ? payloads.slice(0, previewLength) : payloads;
+
+    for (const [index, payload] of sentPayloads.entries()) {
+      const reply = replies.at(index);
+
+      // Only the tail of a long-form preview grows, the messages before it are already full
+      if (isPreview && reply?.content === payload.content) {
+        result.push(reply);
+        continue;
+      }
+
+      const options = {
+        ...payload,
+        allowedMentions: this.getAllowedMentions(message.guildId, config),
+      };
+
+      const edited = reply ? await this.editMessage(reply, options) : null;
+
+      if (edited) {
+        result.push(edited);
+      } else if (index === 0 && (message.guildId !== null || config.dmReplies)) {
+        result.push(await message.reply(options));
       } else {
-        return await message.reply(payload);
+        result.push(await message.channel.send(options));
       }
     }
 
-    return null;
+    if (isPreview) {
+      return [...result, ...replies.slice(result.length)];
+    }
+
+    for (const reply of replies.slice(result.length)) {
+      await reply.delete().catch((error) => {
+        if (!this.isUnknownMessageError(error)) {
+          throw error;
+        }
+      });
+    }
+
+    return result;
+  }
+
+  async sendFallbackMessage(
+    message: Message,
+    content: string,
+    config: DiscordConfig = this.config,
+  ): Promise<Message> {
+    const payload =
+      content.length > 2000
+        ? await this.createFilePayload(content, 'response.md', this.getFileSummary(content))
+        : { content, embeds: [] };
+
+    return await message.channel.send({
+      ...payload,
+      allowedMentions: this.getAllowedMentions(message.guildId, config),
+    });
+  }
+
+  private async editMessage(
+    message: Message,
+    options: BaseMessageOptions,
+  ): Promise<Message | null> {
+    try {
+      return await message.edit(options);
+    } catch (error) {
+      if (this.isUnknownMessageError(error)) {
+        return null;
+      }
+
+      throw error;
+    }
+  }
+
+  isPermissionError(error: unknown): boolean {
+    return (
+      error instanceof DiscordAPIError &&
+      (error.status === 403 ||
+        error.code === RESTJSONErrorCodes.MissingAccess ||
+        error.code === RESTJSONErrorCodes.MissingPermissions)
+    );
+  }
+
+  private isUnknownMessageError(error: unknown): boolean {
+    return error instanceof DiscordAPIError && error.code === RESTJSONErrorCodes.UnknownMessage;
+  }
+
+  private async createPayloads(
+    message: Message,
+    content: string,
+    isPreview: boolean,
+    config: DiscordConfig,
+  ): Promise<BaseMessageOptions[]> {
+    const { replyPrefix = '', replySuffix = '' } = isPreview ? {} : config;
+
+    // Previews carry the quote as well, so the top of the reply does not jump once it is final
+    const prefix = `${this.getPromptQuote(message, config)}${replyPrefix}`;
+
+    if (config.responseFormat === ResponseFormatEnum.EMBED) {
+      return [
+        await this.createEmbedPayload(message, `${replyPrefix}${content}${replySuffix}`, config),
+      ];
+    }
+
+    if (!isPreview && config.fileThreshold && content.length > config.fileThreshold) {
+      return [
+        await this.createFilePayload(
+          content,
+          'response.md',
+          `${prefix}${this.getFileSummary(content)}${replySuffix}`,
+        ),
+      ];
+    }
+
+    // The prefix and suffix are added after splitting, so every segment reserves room for them
+    // and they appear exactly once: on the first and the last message respectively.
+    const limit = 2000 - prefix.length - replySuffix.length;
+    const { maxReplyMessages } = config;
+
+    let segments = splitText(content, limit);
+    let remainder = '';
+
+    // Past the cap the rest of the reply is attached to the last message as a file
+    if (!isPreview && maxReplyMessages && segments.length > maxReplyMessages) {
+      segments = splitText(content, limit - CONTINUATION_NOTE.length);
+      remainder = segments.splice(maxReplyMessages).join('\n');
+      segments[segments.length - 1] += CONTINUATION_NOTE;
+    }
+
+    const files = remainder ? [await this.createTextAttachment(remainder, 'continuation.md')] : [];
+
+    return segments.map((content, index) => {
+      const isLast = index === segments.length - 1;
+
+      return {
+        content: `${index === 0 ? prefix : ''}${content}${isLast ? replySuffix : ''}`,
+        files: isLast ? files : [],
+        embeds: [],
+      };
+    });
+  }
+
+  // Undoes what createPayloads adds around a response, so that none of it comes back as history
+  // and the model does not learn to write it itself
+  stripReplyDecorations(content: string): string {
+    const replyPrefix = this.config.replyPrefix?.trim();
+    const replySuffix = this.config.replySuffix?.trim();
+
+    let result = this.stripPromptQuote(content).trim();
+
+    if (replyPrefix && result.startsWith(replyPrefix)) {
+      result = result.slice(replyPrefix.length).trimStart();
+    }
+
+    if (replySuffix && result.endsWith(replySuffix)) {
+      result = result.slice(0, -replySuffix.length).trimEnd();
+    }
+
+    if (result.endsWith(CONTINUATION_NOTE.trim())) {
+      result = result.slice(0, -CONTINUATION_NOTE.trim().length).trimEnd();
+    }
+
+    return result;
+  }
+
+  private stripPromptQuote(content: string): string {
+    if (!this.config.quotePrompt || !content.startsWith('> ')) {
+      return content;
+    }
+
+    const newline = content.indexOf('\n');
+
+    return newline === -1 ? '' : content.slice(newline + 1);
+  }
+
+  private getPromptQuote(message: Message, config: DiscordConfig): string {
+    if (!config.quotePrompt) {
+      return '';
+    }
+
+    const excerpt = truncateText(
+      message.cleanContent.replace(/\s+/g, ' ').trim(),
+      PROMPT_QUOTE_LENGTH,
+    );
+
+    return excerpt ? `> ${excerpt}\n` : '';
+  }
+
+  private getFileSummary(content: string): string {
+    return `${splitText(content, FILE_SUMMARY_LENGTH)[0]}…\n\n📎 Полный ответ во вложении`;
+  }
+
+  private async createFilePayload(
+    content: string,
+    name: string = 'message.txt',
+    summary: string = '',
+  ): Promise<BaseMessageOptions> {
+    return {
+      files: [await this.createTextAttachment(content, name)],
+      content: summary,
+      embeds: [],
+    };
+  }
+
+  private async createEmbedPayload(
+    message: Message,
+    content: string,
+    config: DiscordConfig,
+  ): Promise<BaseMessageOptions> {
+    const title = this.getDisplayPrompt(message, MAX_EMBED_TITLE_LENGTH, config);
+
+    const descriptions = splitText(content, 4096);
+
+    if (descriptions.length > 10 || title.length + content.length > 6000) {
+      return this.createFilePayload(content);
+    }
+
+    return {
+      content: '',
+      embeds: descriptions.map((description, index) => {
+        const embed = new EmbedBuilder().setDescription(description);
+
+        if (index === 0) {
+          embed.setAuthor({
+            name: message.member?.displayName ?? message.author.displayName,
+            iconURL: message.author.displayAvatarURL(),
+          });
+
+          if (title) {
+            embed.setTitle(title);
+          }
+        }
+
+        return embed;
+      }),
+    };
   }
 }
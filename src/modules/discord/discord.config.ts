@@ -1,3 +1,384 @@
-export class DiscordConfig {
+import { Type } from 'class-transformer';
+import {
+  IsBoolean,
+  IsEnum,
+  IsIn,
+  IsInt,
+  IsNotEmpty,
+  IsNumber,
+  IsOptional,
+  IsPositive,
+  IsString,
+  Matches,
+  Max,
+  MaxLength,
+  Min,
+  ValidateIf,
+  ValidateNested,
+} from 'class-validator';
+
+import { ConfigStore } from '../../common/config';
+import {
+  IsExclusiveWith,
+  IsRegExp,
+  IsTemplate,
+  TEXT_ENCODINGS,
+  ValidateRecord,
+} from '../../utils';
+import { ANTHROPIC_MODELS, VerbosityEnum } from '../anthropic';
+
+import {
+  FeatureFlagEnum,
+  HistoryTimestampsEnum,
+  MassMentionPolicyEnum,
+  MentionPolicyEnum,
+  PromptSanitizationEnum,
+  ResponseFormatEnum,
+} from './dto/enum';
+
+// USD per million tokens
+export class ModelPrice {
+  @IsNumber()
+  @Min(0)
+  input: number;
+
+  @IsNumber()
+  @Min(0)
+  output: number;
+}
+
+// Prompts are matched ignoring case and the mention of the bot, either exactly by text or by
+// pattern. A macro has exactly one of the two
+export class MacroConfig {
+  @ValidateIf((macro: MacroConfig) => macro.pattern === undefined || macro.text !== undefined)
+  @IsString()
+  @IsNotEmpty()
+  @IsExclusiveWith('pattern')
+  text?: string;
+
+  @ValidateIf((macro: MacroConfig) => macro.text === undefined)
+  @IsRegExp()
+  pattern?: string;
+
+  @IsString()
+  @IsNotEmpty()
+  @MaxLength(2000)
+  response: string;
+
+  // By default the canned response replaces the completion
+  @IsOptional()
+  @IsBoolean()
+  complete?: boolean;
+}
+
+export class DiscordGuildConfig {
+  @IsOptional()
+  @IsBoolean()
+  replyMention?: boolean;
+
+  @IsOptional()
+  @IsBoolean()
+  allowMentions?: boolean;
+
+  @IsOptional()
+  @IsIn(ANTHROPIC_MODELS, { each: true })
+  models?: string[];
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  minPromptLength?: number;
+
+  @IsOptional()
+  @IsEnum(VerbosityEnum)
+  verbosity?: VerbosityEnum;
+
+  @IsOptional()
+  @IsString()
+  @IsNotEmpty()
+  responseLanguage?: string;
+
+  @IsOptional()
+  @IsTemplate()
+  systemMessage?: string;
+
+  @IsOptional()
+  @IsBoolean()
+  channelContext?: boolean;
+
+  // Encoding of text attachments that are not valid UTF-8 and carry no BOM
+  @IsOptional()
+  @IsIn(TEXT_ENCODINGS)
+  textEncoding?: string;
+}
+
+export class DiscordConfig extends DiscordGuildConfig {
+  @IsString()
+  @IsNotEmpty()
   botToken: string;
+
+  @IsOptional()
+  @Matches(/^\d{17,20}$/, {
+    each: true,
+    message: 'adminIds must contain only Discord user ids',
+  })
+  adminIds?: string[];
+
+  @IsOptional()
+  @Matches(/^\d{17,20}$/, {
+    message: 'debugChannelId must be a Discord channel id',
+  })
+  debugChannelId?: string;
+
+  @IsOptional()
+  @IsBoolean()
+  directMessages?: boolean;
+
+  @IsOptional()
+  @IsBoolean()
+  dmReplies?: boolean;
+
+  @IsOptional()
+  @IsInt()
+  @Min(1)
+  @Max(100)
+  dmHistoryMessages?: number;
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  dmHistoryWindow?: number;
+
+  @IsOptional()
+  @IsBoolean()
+  threadStarterContext?: boolean;
+
+  // Replies to other users engage the bot only when it is mentioned, unless set to true
+  @IsOptional()
+  @IsBoolean()
+  foreignReplies?: boolean;
+
+  @IsOptional()
+  @Matches(/^\d{17,20}$/, {
+    each: true,
+    message: 'assistantIds must contain only Discord user or webhook ids',
+  })
+  assistantIds?: string[];
+
+  @IsOptional()
+  @IsBoolean()
+  annotateAssistants?: boolean;
+
+  @IsOptional()
+  @IsEnum(FeatureFlagEnum, { each: true })
+  features?: FeatureFlagEnum[];
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  attachmentsConcurrency?: number;
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  attachmentTimeout?: number;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  maxAttachmentsPerMessage?: number;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  downloadRetries?: number;
+
+  @IsOptional()
+  @IsString()
+  refusalNotice?: string;
+
+  // Appends the token usage of the response to the final reply
+  @IsOptional()
+  @IsBoolean()
+  usageFooter?: boolean;
+
+  // Keyed by model, the footer shows the estimated cost of responses by the listed models
+  @IsOptional()
+  @ValidateRecord(() => ModelPrice)
+  modelPrices?: Record<string, ModelPrice>;
+
+  @IsOptional()
+  @IsString()
+  @MaxLength(500)
+  replyPrefix?: string;
+
+  @IsOptional()
+  @IsString()
+  @MaxLength(500)
+  replySuffix?: string;
+
+  @IsOptional()
+  @IsString({ each: true })
+  @IsNotEmpty({ each: true })
+  strippedPrefixes?: string[];
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  emptyCompletionRetries?: number;
+
+  @IsOptional()
+  @IsString()
+  busyNotice?: string;
+
+  // Requests running or waiting in the channel ahead of a new one for it to get the busy notice
+  @IsOptional()
+  @IsInt()
+  @Min(1)
+  busyThreshold?: number;
+
+  @IsOptional()
+  @IsString()
+  maintenanceNotice?: string;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  channelQueueLimit?: number;
+
+  // Milliseconds to wait for more messages of the same author, which are then answered as one
+  // turn. Every prompt is delayed by the window
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  messageMergeWindow?: number;
+
+  @IsOptional()
+  @IsString()
+  ackReaction?: string;
+
+  // Added to replies cut off by max_tokens, the author of the prompt reacts with it to continue
+  @IsOptional()
+  @IsString()
+  @IsNotEmpty()
+  continueReaction?: string;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  minEditInterval?: number;
+
+  @IsOptional()
+  @IsInt()
+  @Min(1)
+  maxEditFailures?: number;
+
+  @IsOptional()
+  @IsInt()
+  @Min(1)
+  fileThreshold?: number;
+
+  @IsOptional()
+  @IsInt()
+  @Min(1)
+  maxReplyMessages?: number;
+
+  // Previews spill into follow-up messages as the response grows instead of showing only the
+  // first message until the response is complete
+  @IsOptional()
+  @IsBoolean()
+  longFormPreview?: boolean;
+
+  @IsOptional()
+  @IsInt()
+  @Min(1)
+  promptDisplayLength?: number;
+
+  @IsOptional()
+  @IsBoolean()
+  quotePrompt?: boolean;
+
+  // Initial state of the maintenance mode, it can be toggled at runtime with /maintenance
+  @IsOptional()
+  @IsBoolean()
+  maintenance?: boolean;
+
+  // Adds 👍 and 👎 to final replies, the votes are recorded in the feedback store
+  @IsOptional()
+  @IsBoolean()
+  feedbackReactions?: boolean;
+
+  @IsOptional()
+  @IsBoolean()
+  reactionContext?: boolean;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  conversationTimeout?: number;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  regenerateCooldown?: number;
+
+  @IsOptional()
+  @IsInt()
+  @Min(0)
+  duplicateResponseWindow?: number;
+
+  @IsOptional()
+  @IsBoolean()
+  userNamePrefix?: boolean;
+
+  @IsOptional()
+  @IsEnum(HistoryTimestampsEnum)
+  historyTimestamps?: HistoryTimestampsEnum;
+
+  @IsOptional()
+  @IsEnum(ResponseFormatEnum)
+  responseFormat?: ResponseFormatEnum;
+
+  @IsOptional()
+  @IsEnum(PromptSanitizationEnum)
+  promptSanitization?: PromptSanitizationEnum;
+
+  @IsOptional()
+  @IsEnum(MentionPolicyEnum)
+  mentionPolicy?: MentionPolicyEnum;
+
+  // Removes the mention that triggered the bot from the prompt, whatever the mention policy
+  @IsOptional()
+  @IsBoolean()
+  stripBotMention?: boolean;
+
+  // What to do with prompts that try to make the bot ping @everyone, @here or the whole server
+  @IsOptional()
+  @IsEnum(MassMentionPolicyEnum)
+  massMentionPolicy?: MassMentionPolicyEnum;
+
+  @IsOptional()
+  @IsString()
+  massMentionNotice?: string;
+
+  // Canned responses sent without calling Anthropic, the first matching macro wins
+  @IsOptional()
+  @ValidateNested({ each: true })
+  @Type(() => MacroConfig)
+  macros?: MacroConfig[];
+
+  @IsOptional()
+  @IsString({ each: true })
+  urlContextDomains?: string[];
+
+  @IsOptional()
+  @IsInt()
+  @IsPositive()
+  urlContextMaxLength?: number;
+
+  @IsOptional()
+  @ValidateRecord(() => DiscordGuildConfig)
+  guilds?: Record<string, DiscordGuildConfig>;
 }
+
+export class DiscordConfigStore extends ConfigStore<DiscordConfig> {}
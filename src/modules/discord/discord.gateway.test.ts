@@ -0,0 +1,126 @@
+import { strict as assert } from 'assert';
+import { Message } from 'discord.js';
+import { describe, it } from 'node:test';
+
+import {
+  createClient,
+  createMessage,
+  createUser,
+  FakeChannel,
+  FakeUser,
+} from '../../testing/fake-discord';
+
+import { ChannelPromptService } from './channel-prompt.service';
+import { DiscordUtilsService } from './discord-utils.service';
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
+import { DiscordGateway } from './discord.gateway';
+import { DiscordService } from './discord.service';
+
+const GUILD_ID = '200000000000000001';
+
+const setup = (config: Partial<DiscordConfig> = {}) => {
+  const fake = createClient();
+  const configStore = new DiscordConfigStore({ botToken: 'token', ...config });
+  const discordUtilsService = new DiscordUtilsService(configStore, fake.client);
+
+  // The messages the gateway passed on to be answered
+  const answered: Message[] = [];
+
+  const discordService = {
+    isForeignAssistant: () => false,
+    isActiveConversation: () => false,
+    createMessage: async (message: Message) => {
+      answered.push(message);
+    },
+  } as unknown as DiscordService;
+
+  const gateway = new DiscordGateway(
+    fake.client,
+    configStore,
+    discordUtilsService,
+    {} as ChannelPromptService,
+    discordService,
+  );
+
+  return {
+    gateway,
+    discordUtilsService,
+    answered,
+    fake,
+    channel: new FakeChannel(fake, undefined, GUILD_ID),
+  };
+};
+
+// A reply as the gateway receives it: discord.js fills the replied user from the referenced
+// message Discord sends along, and mentions only hold the users pinged in the content
+const createReply = (
+  channel: FakeChannel,
+  reference: Message,
+  options: { repliedUser?: FakeUser | null; mentioned?: string[] } = {},
+): Message => {
+  const message = createMessage(channel, {
+    content: 'Ответ',
+    reference: { messageId: reference.id, channelId: channel.id },
+  });
+
+  Object.assign(message.mentions, {
+    repliedUser: options.repliedUser === undefined ? reference.author : options.repliedUser,
+    has: (id: string) => !!options.mentioned?.includes(id),
+  });
+
+  return message;
+};
+
+describe('DiscordGateway', () => {
+  describe('replies', () => {
+    it('answers a reply to the bot without fetching the reference', async (t) => {
+      const { gateway, discordUtilsService, answered, fake, channel } = setup();
+      const fetchReference = t.mock.method(discordUtilsService, 'fetchReference');
+
+      const reply = createReply(channel, createMessage(channel, { author: fake.user }));
+
+      await gateway.onMessageCreate(reply);
+
+      assert.deepEqual(answered, [reply]);
+      assert.equal(fetchReference.mock.callCount(), 0);
+    });
+
+    it('ignores a reply to another user without fetching the reference', async (t) => {
+      const { gateway, discordUtilsService, answered, channel } = setup();
+      const fetchReference = t.mock.method(discordUtilsService, 'fetchReference');
+
+      await gateway.onMessageCreate(createReply(channel, createMessage(channel)));
+
+      assert.deepEqual(answered, []);
+      assert.equal(fetchReference.mock.callCount(), 0);
+    });
+
+    it('answers a reply to another user that mentions the bot', async () => {
+      const { gateway, answered, fake, channel } = setup();
+
+      const reply = createReply(channel, createMessage(channel), { mentioned: [fake.user.id] });
+
+      await gateway.onMessageCreate(reply);
+
+      assert.deepEqual(answered, [reply]);
+    });
+
+    it('looks the reference up in the channel cache without a replied user', async (t) => {
+      const { gateway, discordUtilsService, answered, fake, channel } = setup();
+      const fetchReference = t.mock.method(discordUtilsService, 'fetchReference');
+
+      const toBot = createReply(channel, createMessage(channel, { author: fake.user }), {
+        repliedUser: null,
+      });
+      const toOther = createReply(channel, createMessage(channel, { author: createUser() }), {
+        repliedUser: null,
+      });
+
+      await gateway.onMessageCreate(toBot);
+      await gateway.onMessageCreate(toOther);
+
+      assert.deepEqual(answered, [toBot]);
+      assert.equal(fetchReference.mock.callCount(), 0);
+    });
+  });
+});
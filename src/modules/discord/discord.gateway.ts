@@ -1,49 +1,195 @@
 import { InjectDiscordClient, On } from '@discord-nestjs/core';
-import { Inject, Injectable } from '@nestjs/common';
-import { Client, ClientUser, Message } from 'discord.js';
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import {
+  ApplicationCommandOptionChoiceData,
+  AutocompleteInteraction,
+  Client,
+  ClientUser,
+  Interaction,
+  Message,
+  MessageReaction,
+  PartialMessage,
+  PartialMessageReaction,
+  PartialUser,
+  TextBasedChannel,
+  User,
+} from 'discord.js';
 
+import { ChannelPromptService } from './channel-prompt.service';
+import { DiscordUtilsService } from './discord-utils.service';
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
 import { DiscordService } from './discord.service';
 
 @Injectable()
 export class DiscordGateway {
+  private readonly logger = new Logger(DiscordGateway.name);
+
   constructor(
     @InjectDiscordClient()
     private readonly client: Client,
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+    @Inject(DiscordUtilsService)
+    private discordUtilsService: DiscordUtilsService,
+    @Inject(ChannelPromptService)
+    private channelPromptService: ChannelPromptService,
     @Inject(DiscordService)
     private discordBotService: DiscordService,
   ) {}
 
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
   @On('messageCreate')
   async onMessageCreate(message: Message) {
-    if (message.system) {
+    if (message.system || message.author.id === this.client.user?.id) {
       return;
     }
 
-    if (message.guildId === null) {
-      // todo: may be add support
+    // Other assistants only appear in the history, answering them could start an endless loop
+    if (this.discordBotService.isForeignAssistant(message)) {
       return;
     }
 
-    if (
-      !message.mentions.has((this.client.user as ClientUser).id, {
-        ignoreEveryone: true,
-        ignoreRoles: true,
-        ignoreRepliedUser: false,
-      })
-    ) {
+    if (message.guildId === null && !this.config.directMessages) {
+      return;
+    }
+
+    if (message.guildId !== null && !(await this.isAddressed(message))) {
+      return;
+    }
+
+    if (this.isTooShort(message)) {
       return;
     }
 
     await this.discordBotService.createMessage(message);
   }
 
+  @On('interactionCreate')
+  async onInteractionCreate(interaction: Interaction) {
+    if (!interaction.isAutocomplete()) {
+      return;
+    }
+
+    await interaction
+      .respond(this.getAutocompleteChoices(interaction))
+      .catch((error) => this.logger.warn(`Cannot respond to autocomplete: ${error}`));
+  }
+
   @On('messageUpdate')
-  async onMessageUpdate(message: Message) {
+  async onMessageUpdate(
+    oldMessage: Message | PartialMessage,
+    newMessage: Message | PartialMessage,
+  ) {
+    if (oldMessage.content === newMessage.content) {
+      return;
+    }
+
+    const message = newMessage.partial ? await newMessage.fetch().catch(() => null) : newMessage;
+
+    if (!message) {
+      return;
+    }
+
+    // Editing a pinned prompt does not fire channelPinsUpdate, so it would stay cached until the
+    // pins change
+    if (
+      message.pinned ||
+      this.channelPromptService.isSystemMessage(oldMessage.content) ||
+      this.channelPromptService.isSystemMessage(message.content)
+    ) {
+      this.channelPromptService.invalidate(message.channelId);
+    }
+
     await this.discordBotService.updateMessage(message);
   }
 
+  @On('messageReactionAdd')
+  async onMessageReactionAdd(
+    reaction: MessageReaction | PartialMessageReaction,
+    user: User | PartialUser,
+  ) {
+    await this.discordBotService.handleReaction(reaction, user);
+  }
+
+  @On('channelPinsUpdate')
+  async onChannelPinsUpdate(channel: TextBasedChannel) {
+    this.channelPromptService.invalidate(channel.id);
+  }
+
   @On('messageDelete')
   async onMessageDelete(message: Message) {
     await this.discordBotService.deleteMessage(message);
   }
+
+  private getAutocompleteChoices(
+    interaction: AutocompleteInteraction,
+  ): ApplicationCommandOptionChoiceData[] {
+    const option = interaction.options.getFocused(true);
+
+    if (interaction.commandName !== 'prefs' || option.name !== 'model') {
+      return [];
+    }
+
+    const query = option.value.toLowerCase();
+
+    return this.discordUtilsService
+      .getAllowedModels(interaction.guildId)
+      .filter((model) => model.includes(query))
+      .slice(0, 25)
+      .map((model) => ({ name: model, value: model }));
+  }
+
+  // A reply engages the bot only when it replies to the bot itself: users replying to each other
+  // in a channel the bot is talking in should be left alone unless they mention it
+  private async isAddressed(message: Message): Promise<boolean> {
+    const botId = (this.client.user as ClientUser).id;
+
+    if (!message.reference || this.config.foreignReplies) {
+      return (
+        message.mentions.has(botId, {
+          ignoreEveryone: true,
+          ignoreRoles: true,
+          ignoreRepliedUser: false,
+        }) || this.discordBotService.isActiveConversation(message)
+      );
+    }
+
+    const isMentioned = message.mentions.has(botId, {
+      ignoreEveryone: true,
+      ignoreRoles: true,
+      ignoreRepliedUser: true,
+    });
+
+    // discord.js takes the replied user from the referenced message sent along with the reply,
+    // whether the reply pings or not. It is only missing when Discord did not send that message
+    const { repliedUser } = message.mentions;
+
+    if (repliedUser) {
+      return repliedUser.id === botId || isMentioned;
+    }
+
+    if (isMentioned) {
+      return true;
+    }
+
+    const reference =
+      (message.reference.channelId === message.channelId
+        ? message.channel.messages.cache.get(message.reference.messageId ?? '')
+        : undefined) ?? (await this.discordUtilsService.fetchReference(message));
+
+    return reference?.author.id === botId;
+  }
+
+  private isTooShort(message: Message): boolean {
+    const { minPromptLength = 0 } = this.discordUtilsService.getGuildConfig(message.guildId);
+
+    if (message.attachments.size || message.stickers.size) {
+      return false;
+    }
+
+    return message.content.replace(/<@!?\d+>/g, '').trim().length < minPromptLength;
+  }
 }
@@ -2,33 +2,64 @@ import { DiscordModule as NestjsDiscordModule } from '@discord-nestjs/core';
 import { DynamicModule, Module } from '@nestjs/common';
 import { GatewayIntentBits, Partials } from 'discord.js';
 
+import { Cache, InMemoryCache, MeteredCache } from '../../common/cache';
+import { validateConfig } from '../../utils';
 import { AnthropicModule } from '../anthropic';
 
+import { ActiveHandlersRegistry } from './active-handlers.registry';
+import { ChannelPromptService } from './channel-prompt.service';
+import {
+  AskAboutCommand,
+  ExportCommand,
+  FeatureCommand,
+  FeedbackCommand,
+  MaintenanceCommand,
+  PrefsCommand,
+  ReloadCommand,
+  ReplayCommand,
+  TokensCommand,
+} from './commands';
+import { DiscordRateLimitService } from './discord-rate-limit.service';
 import { DiscordUtilsService } from './discord-utils.service';
-import { DiscordConfig } from './discord.config';
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
 import { DiscordGateway } from './discord.gateway';
 import { DiscordService } from './discord.service';
+import { FeatureFlagsService } from './feature-flags.service';
+import { FeedbackStore, InMemoryFeedbackStore } from './feedback.store';
+import { UrlContextService } from './url-context.service';
+import { InMemoryUserPrefsStore, UserPrefsStore } from './user-prefs.store';
+
+const MAX_CACHED_SYSTEM_MESSAGES = 1000;
 
 @Module({})
 export class DiscordModule {
-  static register({ botToken }: DiscordConfig): DynamicModule {
+  static register(config: DiscordConfig): DynamicModule {
+    validateConfig(DiscordConfig, config);
+
     return {
       module: DiscordModule,
       imports: [
         AnthropicModule.forFeature(),
+        NestjsDiscordModule.forFeature(),
         NestjsDiscordModule.forRootAsync({
           useFactory: () => ({
-            token: botToken,
+            token: config.botToken,
             discordClientOptions: {
               intents: [
                 GatewayIntentBits.Guilds,
                 GatewayIntentBits.GuildMessages,
+                GatewayIntentBits.GuildMessageReactions,
                 GatewayIntentBits.GuildIntegrations,
                 GatewayIntentBits.DirectMessages,
                 GatewayIntentBits.DirectMessageTyping,
                 GatewayIntentBits.MessageContent,
               ],
-              partials: [Partials.Channel, Partials.Channel, Partials.Reaction],
+              partials: [
+                Partials.Channel,
+                Partials.Message,
+                Partials.Reaction,
+                Partials.User,
+              ],
             },
             failOnLogin: true,
             autoLogin: true,
@@ -36,7 +67,45 @@ export class DiscordModule {
           }),
         }),
       ],
-      providers: [DiscordUtilsService, DiscordService, DiscordGateway],
+      providers: [
+        {
+          provide: DiscordConfigStore,
+          useValue: new DiscordConfigStore(config),
+        },
+        {
+          provide: UserPrefsStore,
+          useClass: InMemoryUserPrefsStore,
+        },
+        {
+          provide: FeedbackStore,
+          useClass: InMemoryFeedbackStore,
+        },
+        {
+          provide: Cache,
+          useFactory: () =>
+            new MeteredCache(
+              new InMemoryCache<string>(MAX_CACHED_SYSTEM_MESSAGES),
+              'channel-prompts',
+            ),
+        },
+        ActiveHandlersRegistry,
+        DiscordUtilsService,
+        DiscordRateLimitService,
+        FeatureFlagsService,
+        UrlContextService,
+        ChannelPromptService,
+        DiscordService,
+        DiscordGateway,
+        AskAboutCommand,
+        ExportCommand,
+        FeatureCommand,
+        FeedbackCommand,
+        MaintenanceCommand,
+        PrefsCommand,
+        ReloadCommand,
+        ReplayCommand,
+        TokensCommand,
+      ],
     };
   }
 }
@@ -0,0 +1,709 @@
+import { strict as assert } from 'assert';
+import axios from 'axios';
+import { Message, StickerFormatType } from 'discord.js';
+import { describe, it } from 'node:test';
+import { Observable } from 'rxjs';
+
+import { AppError } from '../../common/errors';
+import { FakeAnthropicService, FakeCompletion } from '../../testing/fake-anthropic';
+import {
+  asUser,
+  createClient,
+  createMessage,
+  createReaction,
+  createUser,
+  FakeChannel,
+  FakeClient,
+  FakeUser,
+} from '../../testing/fake-discord';
+import { createPng } from '../../testing/images';
+import { sleep } from '../../utils';
+import { StopReasonEnum, VerbosityEnum } from '../anthropic';
+import { CreateCompletionResultDto } from '../anthropic/dto/internal';
+
+import { ActiveHandlersRegistry } from './active-handlers.registry';
+import { ChannelPromptService } from './channel-prompt.service';
+import { DiscordRateLimitService } from './discord-rate-limit.service';
+import { DiscordUtilsService } from './discord-utils.service';
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
+import { DiscordService } from './discord.service';
+import { FeatureFlagEnum } from './dto/enum';
+import { FeatureFlagsService } from './feature-flags.service';
+import { InMemoryFeedbackStore } from './feedback.store';
+import { UrlContextService } from './url-context.service';
+import { InMemoryUserPrefsStore } from './user-prefs.store';
+
+const GUILD_ID = '200000000000000001';
+
+const THREADS_PARENT_ID = '300000000000000001';
+
+const setup = (config: Partial<DiscordConfig> = {}, completions?: FakeCompletion[]) => {
+  const fake = createClient();
+  const configStore = new DiscordConfigStore({ botToken: 'token', ...config });
+  const discordUtilsService = new DiscordUtilsService(configStore, fake.client);
+  const featureFlagsService = new FeatureFlagsService(configStore);
+  const anthropicService = new FakeAnthropicService(completions);
+  const userPrefsStore = new InMemoryUserPrefsStore();
+  const feedbackStore = new InMemoryFeedbackStore();
+
+  const channelPromptService = {
+    getSystemMessage: async (message: Message) =>
+      discordUtilsService.getGuildConfig(message.guildId).systemMessage,
+    getChannelContext: () => undefined,
+  } as unknown as ChannelPromptService;
+
+  const urlContextService = {
+    getContext: async () => [],
+  } as unknown as UrlContextService;
+
+  const service = new DiscordService(
+    configStore,
+    discordUtilsService,
+    featureFlagsService,
+    new DiscordRateLimitService(configStore, fake.client),
+    anthropicService.asService,
+    userPrefsStore,
+    feedbackStore,
+    new ActiveHandlersRegistry(),
+    urlContextService,
+    channelPromptService,
+    fake.client,
+  );
+
+  return {
+    service,
+    configStore,
+    featureFlagsService,
+    anthropicService,
+    userPrefsStore,
+    feedbackStore,
+    fake,
+    channel: new FakeChannel(fake, undefined, GUILD_ID),
+  };
+};
+
+describe('DiscordService', () => {
+  describe('prompt', () => {
+    it('notes the stickers of a message', async () => {
+      const { service, anthropicService, channel } = setup();
+
+      const message = createMessage(channel, {
+        content: 'Смотри',
+        stickers: [
+          {
+            id: '1',
+            name: 'Wave',
+            url: 'https://cdn.example.com/1.png',
+            format: StickerFormatType.PNG,
+          },
+        ],
+      });
+
+      await service.replayMessage(message);
+
+      assert.equal(anthropicService.requests[0].message.content, 'Смотри\n(sticker: Wave)');
+      assert.deepEqual(anthropicService.requests[0].message.attachments, []);
+    });
+
+    it('attaches PNG stickers only while the sticker images flag is on', async (t) => {
+      const { service, anthropicService, featureFlagsService, channel } = setup();
+
+      t.mock.method(axios, 'get', async () => ({ data: createPng(160, 160) }));
+
+      const message = createMessage(channel, {
+        stickers: [
+          {
+            id: '1',
+            name: 'Wave',
+            url: 'https://cdn.example.com/1.png',
+            format: StickerFormatType.PNG,
+          },
+        ],
+      });
+
+      await service.replayMessage(message);
+
+      featureFlagsService.setEnabled(FeatureFlagEnum.STICKER_IMAGES, true);
+      await service.replayMessage(message);
+
+      const [withoutFlag, withFlag] = anthropicService.requests;
+
+      assert.deepEqual(withoutFlag.message.attachments, []);
+      assert.deepEqual(
+        withFlag.message.attachments?.map(({ name, contentType }) => ({ name, contentType })),
+        [{ name: 'Wave.png', contentType: 'image/png' }],
+      );
+    });
+
+    it('downloads the attachments concurrently and keeps their order', async (t) => {
+      const { service, anthropicService, channel } = setup();
+
+      let running = 0;
+      let maxRunning = 0;
+
+      t.mock.method(axios, 'get', async (url: string) => {
+        running++;
+        maxRunning = Math.max(maxRunning, running);
+
+        // The first attachment finishes last
+        await sleep(url.endsWith('/0.txt') ? 30 : 5);
+
+        running--;
+
+        return { data: Buffer.from(url) };
+      });
+
+      const message = createMessage(channel, {
+        content: 'Файлы',
+        attachments: [0, 1, 2].map((index) => ({
+          id: `${index}`,
+          name: `${index}.txt`,
+          url: `https://cdn.example.com/${index}.txt`,
+          size: 10,
+          contentType: 'text/plain',
+        })),
+      });
+
+      await service.replayMessage(message);
+
+      assert.deepEqual(
+        anthropicService.requests[0].message.attachments?.map(({ name }) => name),
+        ['0.txt', '1.txt', '2.txt'],
+      );
+      assert.equal(maxRunning, 3);
+    });
+  });
+
+  describe('text encoding', () => {
+    it('passes the encoding of the guild along with the attachments', async (t) => {
+      const { service, anthropicService, fake, channel } = setup({
+        guilds: { [GUILD_ID]: { textEncoding: 'windows-1251' } },
+      });
+
+      t.mock.method(axios, 'get', async () => ({ data: Buffer.from([0xcf, 0xf0, 0xe8]) }));
+
+      const attachments = [
+        {
+          id: '1',
+          name: 'notes.txt',
+          url: 'https://cdn.example.com/notes.txt',
+          size: 3,
+          contentType: 'text/plain',
+        },
+      ];
+
+      await service.replayMessage(createMessage(channel, { attachments }));
+      await service.replayMessage(
+        createMessage(new FakeChannel(fake, undefined, '200000000000000002'), { attachments }),
+      );
+
+      assert.deepEqual(
+        anthropicService.requests.map(({ message }) => message.attachments?.[0].encoding),
+        ['windows-1251', undefined],
+      );
+    });
+  });
+
+  describe('replies', () => {
+    it('never pings everyone, not even in previews', async () => {
+      const { service, channel } = setup({}, [[{ chunk: '@everyone ' }, { chunk: 'привет всем' }]]);
+
+      await service.createMessage(createMessage(channel, { content: 'Поздоровайся' }));
+
+      assert.equal(channel.sent.length, 1);
+      assert.equal(channel.sent[0].content, '@everyone привет всем');
+
+      // The preview and the final edit
+      assert.equal(channel.payloads.length, 2);
+
+      for (const payload of channel.payloads) {
+        assert.deepEqual(payload.allowedMentions?.parse, ['users']);
+      }
+    });
+  });
+
+  describe('errors', () => {
+    it('keeps the partial text of a completion failing mid-stream', async () => {
+      const completion = new Observable<CreateCompletionResultDto>((subscriber) => {
+        subscriber.next({ chunk: 'Начало ответа' });
+        subscriber.error(new AppError('Overloaded'));
+      });
+
+      const { service, channel } = setup({}, [completion]);
+
+      await service.createMessage(createMessage(channel, { content: 'Привет' }));
+
+      assert.equal(channel.sent.length, 1);
+      assert.equal(channel.sent[0].content, 'Начало ответа\n\n⚠️ Ответ прерван из-за ошибки');
+    });
+  });
+
+  describe('busy channel', () => {
+    // A completion that waits for the test to let it finish, keeping its channel busy until then
+    const createGate = () => {
+      let open = () => {};
+      const opened = new Promise<void>((resolve) => (open = resolve));
+
+      const completion = new Observable<CreateCompletionResultDto>((subscriber) => {
+        void opened.then(() => {
+          subscriber.next({ chunk: 'Ответ' });
+          subscriber.complete();
+        });
+      });
+
+      return { open, completion };
+    };
+
+    const sendAll = async (service: DiscordService, messages: Message[]): Promise<void> => {
+      const handlers: Promise<void>[] = [];
+
+      for (const message of messages) {
+        handlers.push(service.createMessage(message));
+        await sleep(10);
+      }
+
+      await Promise.all(handlers);
+    };
+
+    it('posts the busy notice once the requests ahead reach the threshold', async () => {
+      const { open, completion } = createGate();
+      const { service, channel } = setup({ busyNotice: 'Занят', busyThreshold: 2 }, [completion]);
+
+      const messages = [0, 1, 2].map(() => createMessage(channel, { content: 'Привет' }));
+      const sending = sendAll(service, messages);
+
+      await sleep(40);
+      open();
+      await sending;
+
+      const notices = channel.sent.filter(({ content }) => content === 'Занят');
+
+      assert.equal(notices.length, 1);
+      assert.equal(notices[0].reference?.messageId, messages[2].id);
+    });
+
+    it('rejects the requests over the queue limit of the channel', async () => {
+      const { open, completion } = createGate();
+      const { service, anthropicService, channel } = setup(
+        { busyNotice: 'Занят', channelQueueLimit: 1 },
+        [completion],
+      );
+
+      const messages = [0, 1, 2].map(() => createMessage(channel, { content: 'Привет' }));
+      const sending = sendAll(service, messages);
+
+      await sleep(40);
+      open();
+      await sending;
+
+      assert.equal(anthropicService.requests.length, 2);
+      assert.ok(
+        channel.sent.some(
+          ({ content, reference }) =>
+            content === 'Занят' && reference?.messageId === messages[2].id,
+        ),
+      );
+    });
+  });
+
+  describe('duplicate prompts', () => {
+    it('reuses the response to an identical prompt within the window', async () => {
+      const { service, anthropicService, channel } = setup({ duplicateResponseWindow: 60 });
+      const user = createUser();
+
+      await service.createMessage(createMessage(channel, { author: user, content: 'Привет' }));
+      await service.createMessage(createMessage(channel, { author: user, content: 'Привет' }));
+      await service.createMessage(createMessage(channel, { author: user, content: 'Пока' }));
+
+      assert.equal(anthropicService.requests.length, 2);
+      assert.deepEqual(
+        channel.sent.map(({ content }) => content),
+        ['Ответ', 'Ответ\n\n↩️ Тот же ответ, что и в прошлый раз', 'Ответ'],
+      );
+    });
+
+    it('does not reuse the response to a prompt of another user', async () => {
+      const { service, anthropicService, channel } = setup({ duplicateResponseWindow: 60 });
+
+      await service.createMessage(createMessage(channel, { content: 'Привет' }));
+      await service.createMessage(createMessage(channel, { content: 'Привет' }));
+
+      assert.equal(anthropicService.requests.length, 2);
+    });
+  });
+
+  describe('export', () => {
+    const createConversation = (fake: FakeClient, channel: FakeChannel, user: FakeUser) => {
+      const prompt = createMessage(channel, {
+        author: user,
+        content: 'Что на картинке?',
+        createdAt: new Date(2024, 0, 15, 10, 30),
+        attachments: [
+          {
+            id: '1',
+            name: 'cat.png',
+            url: 'https://cdn.example.com/cat.png',
+            size: 100,
+            contentType: 'image/png',
+          },
+        ],
+      });
+      const reply = createMessage(channel, {
+        author: fake.user,
+        content: 'Кот',
+        createdAt: new Date(2024, 0, 15, 10, 31),
+        reference: { messageId: prompt.id, channelId: channel.id },
+      });
+
+      return createMessage(channel, {
+        author: user,
+        content: 'Спасибо',
+        createdAt: new Date(2024, 0, 15, 10, 32),
+        reference: { messageId: reply.id, channelId: channel.id },
+      });
+    };
+
+    it('exports the turns of the conversation as Markdown', async () => {
+      const { service, fake, channel } = setup();
+      const user = createUser(undefined, 'Алиса');
+
+      const markdown = await service.exportConversation(
+        createConversation(fake, channel, user),
+        user.id,
+      );
+
+      assert.equal(
+        markdown,
+        [
+          '# Разговор от 2024-01-15',
+          '### 👤 Алиса — 2024-01-15 10:30',
+          'Что на картинке?',
+          '![cat.png](https://cdn.example.com/cat.png)',
+          '### 🤖 Bot — 2024-01-15 10:31',
+          'Кот',
+          '### 👤 Алиса — 2024-01-15 10:32',
+          'Спасибо',
+        ].join('\n\n'),
+      );
+    });
+
+    it('exports nothing to a user who is not part of the conversation', async () => {
+      const { service, fake, channel } = setup();
+
+      const message = createConversation(fake, channel, createUser());
+
+      assert.equal(await service.exportConversation(message, createUser().id), null);
+    });
+  });
+
+  describe('threads', () => {
+    it('keeps a separate conversation per thread for the same user', async () => {
+      const { service, anthropicService, featureFlagsService, fake } = setup(
+        { conversationTimeout: 600 },
+        [[{ chunk: 'Ответ A' }], [{ chunk: 'Ответ B' }], [{ chunk: 'Ещё ответ' }]],
+      );
+      const user = createUser();
+      const threadA = new FakeChannel(fake, undefined, GUILD_ID, THREADS_PARENT_ID);
+      const threadB = new FakeChannel(fake, undefined, GUILD_ID, THREADS_PARENT_ID);
+
+      featureFlagsService.setEnabled(FeatureFlagEnum.CONVERSATION_CONTINUATION, true);
+
+      await service.createMessage(createMessage(threadA, { author: user, content: 'Вопрос A' }));
+      await service.createMessage(createMessage(threadB, { author: user, content: 'Вопрос B' }));
+
+      const followUpA = createMessage(threadA, { author: user, content: 'Дальше A' });
+      const followUpB = createMessage(threadB, { author: user, content: 'Дальше B' });
+
+      assert.ok(service.isActiveConversation(followUpA));
+      assert.ok(service.isActiveConversation(followUpB));
+
+      await service.createMessage(followUpA);
+      await service.createMessage(followUpB);
+
+      const [, , historyA, historyB] = anthropicService.histories.map((history) =>
+        history.map(({ content }) => content),
+      );
+
+      assert.deepEqual(historyA, ['Ответ A', 'Вопрос A']);
+      assert.deepEqual(historyB, ['Ответ B', 'Вопрос B']);
+    });
+
+    it('does not continue a conversation of another thread', async () => {
+      const { service, featureFlagsService, fake } = setup({ conversationTimeout: 600 });
+      const user = createUser();
+      const threadA = new FakeChannel(fake, undefined, GUILD_ID, THREADS_PARENT_ID);
+      const threadB = new FakeChannel(fake, undefined, GUILD_ID, THREADS_PARENT_ID);
+
+      featureFlagsService.setEnabled(FeatureFlagEnum.CONVERSATION_CONTINUATION, true);
+
+      await service.createMessage(createMessage(threadA, { author: user, content: 'Вопрос' }));
+
+      assert.ok(!service.isActiveConversation(createMessage(threadB, { author: user })));
+      assert.ok(!service.isActiveConversation(createMessage(threadA)));
+    });
+  });
+
+  describe('reactions', () => {
+    it('regenerates once for a burst of duplicate reactions', async () => {
+      const { service, anthropicService, featureFlagsService, channel } = setup();
+      const user = createUser();
+
+      featureFlagsService.setEnabled(FeatureFlagEnum.REACTION_CONTROLS, true);
+
+      await service.createMessage(createMessage(channel, { author: user, content: 'Привет' }));
+
+      const reaction = createReaction(channel.sent[0], '🔄');
+
+      // Each duplicate arrives once the previous regeneration finished
+      for (let index = 0; index < 3; index++) {
+        await service.handleReaction(reaction, asUser(user));
+      }
+
+      assert.equal(anthropicService.requests.length, 2);
+    });
+  });
+
+  describe('feedback', () => {
+    it('records a 👍 reaction as a positive vote keyed to the reply', async () => {
+      const { service, feedbackStore, channel } = setup({ feedbackReactions: true });
+      const user = createUser();
+
+      const message = createMessage(channel, { content: 'Привет' });
+
+      await service.createMessage(message);
+
+      const reply = channel.sent[0];
+
+      await service.handleReaction(createReaction(reply, '👍'), asUser(user));
+
+      const votes = await feedbackStore.getVotes(reply.id);
+
+      assert.equal(votes.length, 1);
+      assert.equal(votes[0].isPositive, true);
+      assert.equal(votes[0].userId, user.id);
+      assert.equal(votes[0].messageId, message.id);
+      assert.equal(votes[0].channelId, channel.id);
+    });
+  });
+
+  describe('continuation', () => {
+    it('resumes a response cut off by max_tokens from where it stopped', async () => {
+      const { service, anthropicService, channel } = setup({ continueReaction: '▶️' }, [
+        [{ chunk: 'Начало ', stopReason: StopReasonEnum.MAX_TOKENS }],
+        [{ chunk: ' конец', stopReason: StopReasonEnum.END_TURN }],
+      ]);
+      const user = createUser();
+
+      await service.createMessage(createMessage(channel, { author: user, content: 'Привет' }));
+
+      const reply = channel.sent[0];
+
+      // Only the author of the prompt may continue the response
+      await service.handleReaction(createReaction(reply, '▶️'), asUser(createUser()));
+      await service.handleReaction(createReaction(reply, '▶️'), asUser(user));
+
+      assert.deepEqual(
+        anthropicService.requests.map(({ prefill }) => prefill),
+        ['', 'Начало'],
+      );
+      assert.equal(channel.sent.length, 1);
+      assert.equal(reply.content, 'Начало конец');
+    });
+  });
+
+  describe('usage footer', () => {
+    it('appends the tokens and the cost of the usage event to the final reply', async () => {
+      const usage = { model: 'claude-3-5-sonnet-20241022', inputTokens: 1200, outputTokens: 300 };
+
+      const { service, channel } = setup(
+        {
+          usageFooter: true,
+          modelPrices: { 'claude-3-5-sonnet-20241022': { input: 3, output: 15 } },
+        },
+        [[{ chunk: 'Ответ' }, { chunk: '', stopReason: StopReasonEnum.END_TURN, usage }]],
+      );
+
+      await service.createMessage(createMessage(channel, { content: 'Привет' }));
+
+      assert.equal(
+        channel.sent[0].content,
+        'Ответ\n\n-# 🪙 Токены: 1200 на входе, 300 на выходе · ≈ $0.0081',
+      );
+    });
+
+    it('leaves the cost out for a model without a price', async () => {
+      const usage = { model: 'claude-3-haiku-20240307', inputTokens: 10, outputTokens: 5 };
+
+      const { service, channel } = setup({ usageFooter: true }, [
+        [{ chunk: 'Ответ' }, { chunk: '', usage }],
+      ]);
+
+      await service.createMessage(createMessage(channel, { content: 'Привет' }));
+
+      assert.equal(channel.sent[0].content, 'Ответ\n\n-# 🪙 Токены: 10 на входе, 5 на выходе');
+    });
+  });
+
+  describe('merge window', () => {
+    it('answers quick successive messages of a user with one merged completion', async () => {
+      const { service, anthropicService, channel } = setup({ messageMergeWindow: 20 });
+      const user = createUser();
+
+      const first = service.createMessage(
+        createMessage(channel, { author: user, content: 'Привет' }),
+      );
+      const second = service.createMessage(
+        createMessage(channel, { author: user, content: 'как дела?' }),
+      );
+
+      await Promise.all([first, second]);
+
+      assert.deepEqual(
+        anthropicService.requests.map(({ message }) => message.content),
+        ['Привет\nкак дела?'],
+      );
+      // The first message is part of the turn, not of its history
+      assert.deepEqual(anthropicService.histories, [[]]);
+      assert.equal(channel.sent.length, 1);
+    });
+
+    it('does not merge the messages of different users', async () => {
+      const { service, anthropicService, channel } = setup({ messageMergeWindow: 20 });
+
+      await Promise.all([
+        service.createMessage(createMessage(channel, { content: 'Привет' })),
+        service.createMessage(createMessage(channel, { content: 'Здравствуйте' })),
+      ]);
+
+      assert.deepEqual(
+        anthropicService.requests.map(({ message }) => message.content),
+        ['Привет', 'Здравствуйте'],
+      );
+    });
+  });
+
+  describe('macros', () => {
+    const macros = [
+      { text: 'Правила', response: 'Правила сервера: …' },
+      { pattern: '^где .*(скачать|загрузить)', response: 'Ссылка на загрузку: …' },
+    ];
+
+    it('answers a prompt matching a macro exactly without the model', async () => {
+      const { service, anthropicService, channel } = setup({ macros });
+
+      await service.createMessage(createMessage(channel, { content: '  правила ' }));
+
+      assert.equal(anthropicService.requests.length, 0);
+      assert.deepEqual(
+        channel.sent.map(({ content }) => content),
+        ['Правила сервера: …'],
+      );
+    });
+
+    it('answers a prompt matching the pattern of a macro without the model', async () => {
+      const { service, anthropicService, channel } = setup({ macros });
+
+      await service.createMessage(createMessage(channel, { content: 'Где можно скачать бота?' }));
+
+      assert.equal(anthropicService.requests.length, 0);
+      assert.deepEqual(
+        channel.sent.map(({ content }) => content),
+        ['Ссылка на загрузку: …'],
+      );
+    });
+
+    it('passes a prompt matching no macro to the model', async () => {
+      const { service, anthropicService, channel } = setup({ macros });
+
+      await service.createMessage(createMessage(channel, { content: 'Какие правила у шахмат?' }));
+
+      assert.equal(anthropicService.requests.length, 1);
+      assert.deepEqual(
+        channel.sent.map(({ content }) => content),
+        ['Ответ'],
+      );
+    });
+
+    it('still completes the prompt when the macro asks to', async () => {
+      const { service, anthropicService, channel } = setup({
+        macros: [{ text: 'Привет', response: 'Секунду…', complete: true }],
+      });
+
+      await service.createMessage(createMessage(channel, { content: 'Привет' }));
+
+      assert.equal(anthropicService.requests.length, 1);
+      assert.deepEqual(
+        channel.sent.map(({ content }) => content),
+        ['Секунду…', 'Ответ'],
+      );
+    });
+  });
+
+  describe('reload', () => {
+    it('finishes a reply with the config it started with', async () => {
+      let reload = () => {};
+
+      const completion = new Observable<CreateCompletionResultDto>((subscriber) => {
+        subscriber.next({ chunk: 'Первый' });
+        reload();
+        subscriber.complete();
+      });
+
+      const { service, configStore, channel } = setup({ replyPrefix: 'old: ' }, [
+        completion,
+        [{ chunk: 'Второй' }],
+      ]);
+
+      reload = () => configStore.set({ ...configStore.get(), replyPrefix: 'new: ' });
+
+      await service.createMessage(createMessage(channel, { content: 'Привет' }));
+      await service.createMessage(createMessage(channel, { content: 'Привет' }));
+
+      assert.deepEqual(
+        channel.sent.map(({ content }) => content),
+        ['old: Первый', 'new: Второй'],
+      );
+    });
+  });
+
+  describe('preferences', () => {
+    it('applies the stored preferences to the requests of their user only', async () => {
+      const { service, anthropicService, userPrefsStore, channel } = setup();
+
+      const alice = createUser();
+      const bob = createUser();
+
+      await userPrefsStore.set(alice.id, {
+        model: 'claude-3-opus-20240229',
+        verbosity: VerbosityEnum.CONCISE,
+        language: 'English',
+      });
+
+      await service.replayMessage(createMessage(channel, { author: alice, content: 'Привет' }));
+      await service.replayMessage(createMessage(channel, { author: bob, content: 'Привет' }));
+
+      assert.deepEqual(anthropicService.requests[0].preferences, {
+        model: 'claude-3-opus-20240229',
+        verbosity: VerbosityEnum.CONCISE,
+        language: 'English',
+      });
+      assert.deepEqual(anthropicService.requests[1].preferences, {
+        verbosity: undefined,
+        language: undefined,
+      });
+    });
+
+    it('drops a stored model the guild does not allow', async () => {
+      const { service, anthropicService, userPrefsStore, channel } = setup({
+        guilds: { [GUILD_ID]: { models: ['claude-3-haiku-20240307'] } },
+      });
+
+      const user = createUser();
+
+      await userPrefsStore.set(user.id, { model: 'claude-3-opus-20240229' });
+      await service.replayMessage(createMessage(channel, { author: user, content: 'Привет' }));
+
+      assert.equal(anthropicService.requests[0].preferences?.model, undefined);
+    });
+  });
+});
@@ -1,193 +1,1735 @@
 import { InjectDiscordClient } from '@discord-nestjs/core';
 import { Inject, Injectable, Logger } from '@nestjs/common';
 import axios from 'axios';
-import { Client, Message } from 'discord.js';
+import { createHash } from 'crypto';
+import { format, formatDistanceToNow } from 'date-fns';
+import {
+  Client,
+  Message,
+  MessageReaction,
+  PartialMessageReaction,
+  PartialUser,
+  PermissionFlagsBits,
+  StickerFormatType,
+  User,
+  cleanContent,
+} from 'discord.js';
 
+import { AppError, ServiceUnavailableError } from '../../common/errors';
+import { KeyedMutex, mapConcurrently, sanitizeText, sleep, splitText } from '../../utils';
 import {
   AnthropicService,
   CompletionAttachment,
   CompletionMessage,
+  CompletionPreferences,
   GetPreviousMessage,
   MessageRoleEnum,
+  PromptTemplateData,
+  StopReasonEnum,
+  TokenEstimate,
+  TokenUsage,
 } from '../anthropic';
 
+import { ActiveHandler, ActiveHandlersRegistry } from './active-handlers.registry';
+import { ChannelPromptService } from './channel-prompt.service';
+import { DiscordRateLimitService } from './discord-rate-limit.service';
 import { DiscordUtilsService } from './discord-utils.service';
+import { DiscordConfig, DiscordConfigStore, MacroConfig } from './discord.config';
+import {
+  FeatureFlagEnum,
+  HistoryTimestampsEnum,
+  MassMentionPolicyEnum,
+  MentionPolicyEnum,
+  PromptSanitizationEnum,
+} from './dto/enum';
+import { FeatureFlagsService } from './feature-flags.service';
+import { FeedbackStore } from './feedback.store';
+import { UrlContextService } from './url-context.service';
+import { UserPrefsStore } from './user-prefs.store';
+
+const MAX_EMPTY_COMPLETION_RETRIES = 3;
+
+const STOP_REACTION = '⏹';
+
+const REGENERATE_REACTION = '🔄';
+
+const UPVOTE_REACTION = '👍';
+
+const DOWNVOTE_REACTION = '👎';
+
+const REACTION_DEDUP_TTL = 5000;
+
+const REGENERATE_NOTICE_TTL = 5000;
+
+// Permissions may be fixed at any time, so a channel is only skipped for a while
+const FORBIDDEN_CHANNEL_TTL = 10 * 60 * 1000;
+
+const PERMISSION_NOTICE_INTERVAL = 60 * 60 * 1000;
+
+const ASK_ABOUT_MESSAGE_PROMPT =
+  'Explain and analyze the following Discord message, including its attachments:';
+
+const DEFAULT_BUSY_NOTICE = 'Я пока занят предыдущими запросами, попробуй чуть позже ⏳';
+
+const DEFAULT_BUSY_THRESHOLD = 1;
+
+const DEFAULT_MAINTENANCE_NOTICE = 'Идут технические работы, попробуй чуть позже 🛠';
+
+const DEFAULT_MASS_MENTION_NOTICE = 'Я не упоминаю всех участников сервера 🙅';
+
+const MASS_MENTION_PATTERNS: RegExp[] = [
+  /@(everyone|here)\b/i,
+  /\b(mention|ping|tag|notify|alert)\s+(every(one|body)|all\b|the\s+whole\s+server)/i,
+  /(упомян|тегн|тегай|пингу|пинган|отметь|отмечай|позов)\S*\s+(всех|весь\s+сервер)/i,
+];
+
+const EDIT_DEBOUNCE = 1500;
+
+const DOWNLOAD_RETRY_DELAY = 500;
+
+const DEFAULT_ATTACHMENT_TIMEOUT = 60000;
+
+const DUPLICATE_RESPONSE_NOTE = '↩️ Тот же ответ, что и в прошлый раз';
+
+const MAX_TRACKED_REPLIES = 1000;
+
+const DEFAULT_MAX_EDIT_FAILURES = 3;
+
+const DANGLING_SURROGATE_PATTERN = /[\uD800-\uDBFF]$/;
+
+const USER_MENTION_PATTERN = /<@!?(\d{17,20})>/g;
+
+const MENTION_CONTEXT_LOOKBACK = 50;
+
+const MENTION_CONTEXT_MESSAGES = 5;
+
+const MAX_EMBED_CONTEXT_LENGTH = 4000;
+
+const DEFAULT_DM_HISTORY_WINDOW = 3600;
+
+const MAX_REACTION_CONTEXT_EMOJIS = 20;
+
+const MAX_EXPORTED_MESSAGES = 200;
+
+const USAGE_FOOTER_PREFIX = '-# 🪙 ';
 
-interface ProcessedMessage {
-  abortController: AbortController;
-  reply: Message | null;
+const USAGE_FOOTER_PATTERN = /\n*-# 🪙 [^\n]*$/;
+
+interface ActiveConversation {
+  replyId: string;
+  expiresAt: number;
+}
+
+interface RecentResponse {
+  promptHash: string;
+  content: string;
+  expiresAt: number;
+}
+
+interface TruncatedResponse {
+  message: Message;
+  content: string;
+  replies: Message[];
+}
+
+interface PendingMerge {
+  messages: Message[];
+  timer: NodeJS.Timeout;
+  resolve: (messages: Message[] | null) => void;
 }
 
 @Injectable()
 export class DiscordService {
   private readonly logger = new Logger(DiscordService.name);
 
-  private readonly processedMessages: Map<string, ProcessedMessage> = new Map();
+  private readonly activeConversations: Map<string, ActiveConversation> = new Map();
+
+  private readonly completedReplies: Map<string, Message[]> = new Map();
+
+  // Keyed by channel and author, see waitForMerge
+  private readonly pendingMerges: Map<string, PendingMerge> = new Map();
+
+  // The earlier messages of merged turns, keyed by the last message of the turn
+  private readonly mergedMessages: Map<string, Message[]> = new Map();
+
+  private readonly pendingUpdates: Map<string, NodeJS.Timeout> = new Map();
+
+  private readonly handledReactions: Map<string, number> = new Map();
+
+  private readonly regenerateCooldowns: Map<string, number> = new Map();
+
+  // Expiry timestamps keyed by channel
+  private readonly forbiddenChannels: Map<string, number> = new Map();
+
+  // Timestamps of the last missing permissions DM, keyed by user
+  private readonly permissionNotices: Map<string, number> = new Map();
+
+  private readonly recentResponses: Map<string, RecentResponse> = new Map();
+
+  // Keyed by the last reply, which carries the continue reaction
+  private readonly truncatedResponses: Map<string, TruncatedResponse> = new Map();
+
+  private readonly macroPatterns: WeakMap<MacroConfig, RegExp> = new WeakMap();
+
+  private readonly channelMutex = new KeyedMutex();
+
+  private maintenance: boolean;
 
   constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
     @Inject(DiscordUtilsService)
     private discordUtilsService: DiscordUtilsService,
+    @Inject(FeatureFlagsService)
+    private featureFlagsService: FeatureFlagsService,
+    @Inject(DiscordRateLimitService)
+    private discordRateLimitService: DiscordRateLimitService,
     @Inject(AnthropicService)
     private anthropicService: AnthropicService,
+    @Inject(UserPrefsStore)
+    private userPrefsStore: UserPrefsStore,
+    @Inject(FeedbackStore)
+    private feedbackStore: FeedbackStore,
+    @Inject(ActiveHandlersRegistry)
+    private activeHandlers: ActiveHandlersRegistry,
+    @Inject(UrlContextService)
+    private urlContextService: UrlContextService,
+    @Inject(ChannelPromptService)
+    private channelPromptService: ChannelPromptService,
     @InjectDiscordClient()
     private readonly client: Client,
-  ) {}
+  ) {
+    this.maintenance = this.config.maintenance ?? false;
+  }
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  isMaintenance(): boolean {
+    return this.maintenance;
+  }
+
+  setMaintenance(enabled: boolean): void {
+    this.maintenance = enabled;
+    this.logger.log(`Maintenance mode ${enabled ? 'enabled' : 'disabled'}`);
+  }
+
+  async createMessage(
+    message: Message,
+    replies: Message[] = [],
+    prefill: string = '',
+  ): Promise<void> {
+    // A completion that cannot be posted is a waste of tokens
+    if (!this.canReply(message)) {
+      await this.handlePermissionError(message);
+      return;
+    }
+
+    // The bot stays online during maintenance, it only stops calling Anthropic
+    if (this.maintenance) {
+      await message
+        .reply({
+          content: this.config.maintenanceNotice ?? DEFAULT_MAINTENANCE_NOTICE,
+          allowedMentions: this.discordUtilsService.getAllowedMentions(message.guildId),
+        })
+        .catch((error) => this.logger.warn(`Cannot send maintenance notice: ${error}`));
+      return;
+    }
+
+    if (
+      this.config.massMentionPolicy &&
+      this.config.massMentionPolicy !== MassMentionPolicyEnum.ALLOW &&
+      this.isMassMentionAttempt(message)
+    ) {
+      this.logger.warn(
+        `Mass mention attempt: message ${message.id} by user ${message.author.id} in channel ${message.channelId}`,
+      );
 
-  async createMessage(message: Message): Promise<void> {
-    const abortController = new AbortController();
+      if (this.config.massMentionPolicy === MassMentionPolicyEnum.REFUSE) {
+        await message
+          .reply({
+            content: this.config.massMentionNotice ?? DEFAULT_MASS_MENTION_NOTICE,
+            allowedMentions: this.discordUtilsService.getAllowedMentions(message.guildId),
+          })
+          .catch((error) => this.logger.warn(`Cannot send mass mention notice: ${error}`));
+        return;
+      }
+    }
+
+    const macro = !replies.length && !prefill ? this.findMacro(message) : null;
+
+    if (macro) {
+      this.logger.log(`Message ${message.id} matches a macro, sending its canned response`);
+
+      await message
+        .reply({
+          content: macro.response,
+          allowedMentions: this.discordUtilsService.getAllowedMentions(message.guildId),
+        })
+        .catch((error) => this.logger.warn(`Cannot send canned response: ${error}`));
+
+      if (!macro.complete) {
+        return;
+      }
+    }
 
-    const abortTyping = this.discordUtilsService.sendTyping(message.channel);
+    // Registered before waiting for the merge window and the channel, so that deleting or editing
+    // a queued message cancels it before it starts
+    const previousHandler = this.activeHandlers.get(message.id);
 
-    let processedMessage: ProcessedMessage = {
-      abortController,
-      reply: null,
+    const handler: ActiveHandler = {
+      messageId: message.id,
+      authorId: message.author.id,
+      abortController: new AbortController(),
+      replies,
     };
 
-    if (this.processedMessages.has(message.id)) {
-      processedMessage = {
-        ...(this.processedMessages.get(message.id) as ProcessedMessage),
-        abortController,
+    this.activeHandlers.register(handler);
+
+    // Regenerations and continuations answer a turn that was already merged
+    if (this.config.messageMergeWindow && !previousHandler && !replies.length && !prefill) {
+      const messages = await this.waitForMerge(message, this.config.messageMergeWindow);
+
+      if (!messages || handler.abortController.signal.aborted) {
+        this.activeHandlers.complete(handler);
+        return;
+      }
+
+      if (messages.length > 1) {
+        this.trackMergedMessages(message.id, messages.slice(0, -1));
+      }
+    }
+
+    const queueSize = this.channelMutex.getQueueSize(message.channelId);
+
+    if (this.config.channelQueueLimit !== undefined && queueSize > this.config.channelQueueLimit) {
+      await message
+        .reply({
+          content: this.config.busyNotice ?? DEFAULT_BUSY_NOTICE,
+          allowedMentions: this.discordUtilsService.getAllowedMentions(message.guildId),
+        })
+        .catch((error) => this.logger.warn(`Cannot send busy notice: ${error}`));
+
+      this.activeHandlers.complete(handler);
+      return;
+    }
+
+    const busyReply =
+      this.config.busyNotice && queueSize >= (this.config.busyThreshold ?? DEFAULT_BUSY_THRESHOLD)
+        ? message
+            .reply({
+              content: this.config.busyNotice,
+              allowedMentions: this.discordUtilsService.getAllowedMentions(message.guildId),
+            })
+            .catch((error) => {
+              this.logger.warn(`Cannot send busy notice: ${error}`);
+              return null;
+            })
+        : null;
+
+    await this.channelMutex.run(message.channelId, async () => {
+      void busyReply?.then((reply) => reply?.delete().catch(() => null));
+
+      if (handler.abortController.signal.aborted) {
+        this.activeHandlers.complete(handler);
+        return;
+      }
+
+      // A restarted handler continues editing the replies of the one it replaces, which are only
+      // final once that one released the channel
+      handler.replies = previousHandler?.replies ?? replies;
+
+      await this.processMessage(message, handler, replies, prefill);
+    });
+  }
+
+  // Resolves with the messages to answer as one turn once the window passes without another
+  // message of the same author in the channel, or with null when a later message takes it over
+  private waitForMerge(message: Message, window: number): Promise<Message[] | null> {
+    const key = `${message.channelId}:${message.author.id}`;
+    const pending = this.pendingMerges.get(key);
+    const messages = [...(pending?.messages ?? []), message];
+
+    if (pending) {
+      clearTimeout(pending.timer);
+      pending.resolve(null);
+    }
+
+    return new Promise((resolve) => {
+      const merge: PendingMerge = {
+        messages,
+        resolve,
+        // Messages deleted during the window are removed from the merge by deleteMessage
+        timer: setTimeout(() => {
+          this.pendingMerges.delete(key);
+          resolve(merge.messages);
+        }, window),
       };
+
+      this.pendingMerges.set(key, merge);
+    });
+  }
+
+  private trackMergedMessages(messageId: string, messages: Message[]): void {
+    this.mergedMessages.set(messageId, messages);
+
+    if (this.mergedMessages.size > MAX_TRACKED_REPLIES) {
+      this.mergedMessages.delete(this.mergedMessages.keys().next().value);
     }
+  }
+
+  private async processMessage(
+    message: Message,
+    handler: ActiveHandler,
+    initialReplies: Message[],
+    prefill: string,
+  ): Promise<void> {
+    const { abortController } = handler;
 
-    this.processedMessages.set(message.id, processedMessage);
+    // A reload during the completion must not change how its reply is finished
+    const config = this.config;
 
-    let reply: Message | null = processedMessage.reply;
+    const abortTyping = this.discordUtilsService.sendTyping(
+      message.channel,
+      abortController.signal,
+    );
+
+    const ackReaction = config.ackReaction
+      ? message.react(config.ackReaction).catch((error) => {
+          this.logger.warn(`Failed to add ack reaction to message ${message.id}: ${error}`);
+          return null;
+        })
+      : null;
+
+    this.logger.debug(
+      `Processing message ${message.id} by user ${message.author.id}: ` +
+        this.discordUtilsService.getDisplayPrompt(message),
+    );
+
+    let replies: Message[] = handler.replies;
+
+    let content = prefill;
+
+    let editFailures = 0;
+
+    let pendingReply: Promise<void> | null = null;
+
+    const maxEditFailures = config.maxEditFailures ?? DEFAULT_MAX_EDIT_FAILURES;
 
     try {
-      const completionMessage = await this.getCompletionMessage(message);
+      const [completionMessage, preferences, systemMessage] = await Promise.all([
+        this.getPromptMessage(message),
+        this.getPreferences(message.author.id, message.guildId),
+        this.channelPromptService.getSystemMessage(message),
+      ]);
 
-      const completion = await this.anthropicService.createCompletion({
-        signal: abortController.signal,
-        message: completionMessage,
-        getPreviousMessage: this.getPreviousMessage(message),
-      });
+      const context = this.channelPromptService.getChannelContext(message);
 
-      let content = '';
-      let isReplying: boolean = false;
+      const promptHash = config.duplicateResponseWindow
+        ? this.hashPrompt(completionMessage, preferences, systemMessage, context)
+        : null;
 
-      await completion.forEach((value) => {
-        if (abortController.signal.aborted) {
-          return;
+      // Regenerations and edits pass their previous replies and always want a fresh response
+      const duplicateResponse =
+        promptHash && !initialReplies.length ? this.getRecentResponse(message, promptHash) : null;
+
+      if (duplicateResponse) {
+        this.logger.log(`Message ${message.id} repeats the previous prompt, reusing its response`);
+        content = duplicateResponse;
+      }
+
+      let stopReason: StopReasonEnum | undefined;
+
+      let usage: TokenUsage | undefined;
+
+      const retries = Math.min(
+        config.emptyCompletionRetries ?? 0,
+        MAX_EMPTY_COMPLETION_RETRIES,
+      );
+
+      for (let attempt = 0; attempt <= retries && content === prefill; attempt++) {
+        if (attempt > 0) {
+          this.logger.warn(`Empty completion for message ${message.id}, retrying (${attempt})...`);
         }
 
-        content = `${content}${value.chunk}`;
+        const completion = await this.anthropicService.createCompletion({
+          signal: abortController.signal,
+          message: completionMessage,
+          preferences,
+          getPreviousMessage: this.getPromptHistory(message),
+          systemMessage,
+          context,
+          prefill,
+          templateData: this.getTemplateData(message),
+        });
 
-        if (content) {
-          if (!isReplying) {
-            isReplying = true;
+        await completion.forEach((value) => {
+          if (abortController.signal.aborted) {
+            return;
+          }
 
-            this.discordUtilsService
-              .editOrReplyMessage(message, content, reply ?? undefined)
-              .then((message) => {
-                if (message) {
-                  reply = message;
-                }
+          if (value.stopReason) {
+            stopReason = value.stopReason;
+          }
+
+          if (value.usage) {
+            usage = value.usage;
+          }
+
+          content = `${content}${value.chunk}`;
+
+          // A delta may end in the middle of a surrogate pair, so never preview a dangling half.
+          // Leading whitespace is dropped too, otherwise the first preview may look empty
+          const preview = this.stripPrefixes(
+            content.replace(DANGLING_SURROGATE_PATTERN, ''),
+          ).trimStart();
 
-                isReplying = false;
+          if (preview && !pendingReply && editFailures < maxEditFailures) {
+            pendingReply = this.discordUtilsService
+              .editOrReplyMessage(message, preview, replies, true, config)
+              .then((messages) => {
+                editFailures = 0;
+                replies = messages;
+                handler.replies = messages;
+
+                if (abortController.signal.aborted && !this.activeHandlers.has(message.id)) {
+                  void this.deleteReplies(messages);
+                }
+              })
+              .catch((error) => {
+                editFailures++;
+                this.logger.error(error);
+              })
+              .then(() => sleep(this.discordRateLimitService.getEditInterval(message.channelId)))
+              .finally(() => {
+                pendingReply = null;
               });
           }
+        });
+
+        await pendingReply;
+
+        if (abortController.signal.aborted) {
+          return;
         }
-      });
+      }
+
+      if (!content) {
+        throw new AppError(`Empty completion for message ${message.id}`);
+      }
+
+      content = this.stripPrefixes(content) || content;
+
+      if (stopReason === StopReasonEnum.REFUSAL) {
+        this.logger.warn(
+          `Completion refused: message ${message.id} by user ${message.author.id} in channel ${message.channelId}`,
+        );
+
+        if (config.refusalNotice) {
+          content = `${config.refusalNotice}\n\n${content}`;
+        }
+      }
 
+      if (promptHash) {
+        this.setRecentResponse(message, promptHash, content);
+      }
+
+      if (duplicateResponse) {
+        content = `${content}\n\n${DUPLICATE_RESPONSE_NOTE}`;
+      }
+
+      // The footer is not part of the response, so a continuation does not repeat it
+      const footer = config.usageFooter && usage ? this.formatUsageFooter(usage) : null;
+      const reply = footer ? `${content}\n\n${footer}` : content;
+
+      replies =
+        editFailures < maxEditFailures
+          ? await this.discordUtilsService.editOrReplyMessage(
+              message,
+              reply,
+              replies,
+              false,
+              config,
+            )
+          : await this.sendFallbackReply(message, reply, replies, config);
+      handler.replies = replies;
+
+      this.trackReplies(message.id, replies);
+      this.clearContinuation(replies);
+
+      if (replies.length) {
+        this.setActiveConversation(message, replies.at(-1) as Message);
+
+        if (config.feedbackReactions) {
+          void this.addFeedbackReactions(replies.at(-1) as Message);
+        }
+
+        if (stopReason === StopReasonEnum.MAX_TOKENS && config.continueReaction) {
+          void this.offerContinuation(message, content, replies);
+        }
+      }
+    } catch (error) {
       if (abortController.signal.aborted) {
         return;
       }
 
-      await this.discordUtilsService.editOrReplyMessage(message, content, reply ?? undefined);
-    } catch (error) {
+      // A completion failing mid-stream may still be sending its preview, which the error reply
+      // must edit instead of being sent next to it
+      await pendingReply;
+
+      if (this.discordUtilsService.isPermissionError(error)) {
+        await this.handlePermissionError(message);
+        return;
+      }
+
       this.logger.error(error);
 
       await this.discordUtilsService
         .editOrReplyMessage(
           message,
-          'Что-то я затупил, может быть пора отдохнуть 😞',
-          reply ?? undefined,
+          error instanceof ServiceUnavailableError
+            ? error.message
+            : content
+              ? `${content}\n\n⚠️ Ответ прерван из-за ошибки`
+              : 'Что-то я затупил, может быть пора отдохнуть 😞',
+          replies,
+          false,
+          config,
         )
         .catch((error) => this.logger.error(error));
     } finally {
       abortTyping();
 
-      if (!abortController.signal.aborted) {
-        this.processedMessages.delete(message.id);
+      void ackReaction?.then((reaction) =>
+        reaction?.users.remove().catch((error) => {
+          this.logger.warn(`Failed to remove ack reaction from message ${message.id}: ${error}`);
+        }),
+      );
+
+      // A handler stopped by a reaction is not replaced by anything, while a restarted one
+      // already was and stays registered for its successor
+      if (
+        this.activeHandlers.complete(handler) &&
+        abortController.signal.aborted &&
+        handler.replies.length
+      ) {
+        // Editing the message still regenerates the stopped response
+        this.trackReplies(message.id, handler.replies);
+      }
+    }
+  }
+
+  async askAboutMessage(
+    message: Message,
+    user: User,
+    onUpdate: (content: string, isFinal: boolean) => Promise<void>,
+  ): Promise<void> {
+    const completionMessage = await this.getCompletionMessage(message);
+
+    const completion = await this.anthropicService.createCompletion({
+      message: {
+        ...completionMessage,
+        role: MessageRoleEnum.USER,
+        content: `${ASK_ABOUT_MESSAGE_PROMPT}\n\n${completionMessage.content ?? ''}`.trimEnd(),
+      },
+      preferences: await this.getPreferences(user.id, message.guildId),
+      systemMessage: await this.channelPromptService.getSystemMessage(message),
+      context: this.channelPromptService.getChannelContext(message),
+      templateData: {
+        ...this.getTemplateData(message),
+        user: { id: user.id, name: user.displayName },
+      },
+    });
+
+    let content = '';
+    let pendingUpdate: Promise<void> | null = null;
+
+    await completion.forEach(({ chunk }) => {
+      content = `${content}${chunk}`;
+
+      const preview = content.replace(DANGLING_SURROGATE_PATTERN, '');
+
+      if (preview && !pendingUpdate) {
+        pendingUpdate = onUpdate(preview, false)
+          .catch((error) => this.logger.error(error))
+          .then(() => sleep(this.discordRateLimitService.getEditInterval(message.channelId)))
+          .finally(() => {
+            pendingUpdate = null;
+          });
+      }
+    });
+
+    await pendingUpdate;
+
+    if (!content) {
+      throw new AppError(`Empty completion for message ${message.id}`);
+    }
+
+    await onUpdate(this.stripPrefixes(content) || content, true);
+  }
+
+  async replayMessage(message: Message): Promise<string> {
+    const completion = await this.anthropicService.createCompletion({
+      message: await this.getPromptMessage(message),
+      preferences: await this.getPreferences(message.author.id, message.guildId),
+      getPreviousMessage: this.getPromptHistory(message),
+      systemMessage: await this.channelPromptService.getSystemMessage(message),
+      context: this.channelPromptService.getChannelContext(message),
+      templateData: this.getTemplateData(message),
+    });
+
+    let content = '';
+
+    await completion.forEach(({ chunk }) => {
+      content = `${content}${chunk}`;
+    });
+
+    return this.stripPrefixes(content) || content;
+  }
+
+  async estimateTokens(message: Message): Promise<TokenEstimate> {
+    return await this.anthropicService.estimateTokens({
+      message: await this.getPromptMessage(message),
+      preferences: await this.getPreferences(message.author.id, message.guildId),
+      getPreviousMessage: this.getPromptHistory(message),
+      systemMessage: await this.channelPromptService.getSystemMessage(message),
+      context: this.channelPromptService.getChannelContext(message),
+      templateData: this.getTemplateData(message),
+    });
+  }
+
+  // Only a participant of the conversation may export it, null is returned for anyone else
+  async exportConversation(message: Message, userId: string): Promise<string | null> {
+    const getHistoryMessage = this.getHistoryMessage(message);
+    const messages = [message];
+
+    for (let i = 0; i < MAX_EXPORTED_MESSAGES; i++) {
+      const previousMessage = await getHistoryMessage();
+
+      if (!previousMessage) {
+        break;
       }
+
+      messages.unshift(previousMessage);
+    }
+
+    const isParticipant = messages.some(
+      (historyMessage) =>
+        historyMessage.author.id === userId &&
+        this.getMessageRole(historyMessage) === MessageRoleEnum.USER,
+    );
+
+    if (!isParticipant) {
+      return null;
     }
+
+    const turns = messages.map((historyMessage) => {
+      const isAssistant = this.getMessageRole(historyMessage) === MessageRoleEnum.ASSISTANT;
+      const name = historyMessage.member?.displayName ?? historyMessage.author.displayName;
+      const date = format(historyMessage.createdAt, 'yyyy-MM-dd HH:mm');
+
+      // Images are referenced by URL so that Markdown viewers render them inline
+      const attachments = historyMessage.attachments.map((attachment) =>
+        attachment.contentType?.startsWith('image/')
+          ? `![${attachment.name}](${attachment.url})`
+          : `[${attachment.name}](${attachment.url})`,
+      );
+
+      return [
+        `### ${isAssistant ? '🤖' : '👤'} ${name} — ${date}`,
+        [this.getMessageText(historyMessage), ...this.getEmbedContext(historyMessage)]
+          .filter(Boolean)
+          .join('\n\n'),
+        ...attachments,
+      ]
+        .filter(Boolean)
+        .join('\n\n');
+    });
+
+    return [`# Разговор от ${format(message.createdAt, 'yyyy-MM-dd')}`, ...turns].join('\n\n');
   }
 
   async updateMessage(message: Message): Promise<void> {
-    if (this.processedMessages.has(message.id)) {
-      try {
-        this.processedMessages.get(message.id)?.abortController.abort();
-      } catch (e) {}
+    if (!this.activeHandlers.has(message.id) && !this.completedReplies.has(message.id)) {
+      return;
+    }
+
+    clearTimeout(this.pendingUpdates.get(message.id));
+
+    this.pendingUpdates.set(
+      message.id,
+      setTimeout(() => {
+        this.pendingUpdates.delete(message.id);
+        void this.regenerateMessage(message);
+      }, EDIT_DEBOUNCE),
+    );
+  }
 
+  private async regenerateMessage(message: Message, replies: Message[] = []): Promise<void> {
+    if (this.activeHandlers.abort(message.id)) {
       await this.createMessage(message);
+      return;
+    }
+
+    await this.createMessage(message, this.completedReplies.get(message.id) ?? replies);
+  }
+
+  private trackReplies(messageId: string, replies: Message[]): void {
+    this.completedReplies.delete(messageId);
+    this.completedReplies.set(messageId, replies);
+
+    if (this.completedReplies.size > MAX_TRACKED_REPLIES) {
+      this.completedReplies.delete(this.completedReplies.keys().next().value);
     }
   }
 
   async deleteMessage(message: Message): Promise<void> {
-    if (this.processedMessages.has(message.id)) {
-      try {
-        this.processedMessages.get(message.id)?.abortController.abort();
-      } catch (e) {}
+    clearTimeout(this.pendingUpdates.get(message.id));
+    this.pendingUpdates.delete(message.id);
+    this.completedReplies.delete(message.id);
+
+    for (const merge of this.pendingMerges.values()) {
+      merge.messages = merge.messages.filter(({ id }) => id !== message.id);
+    }
+
+    const handler = this.activeHandlers.cancel(message.id);
 
-      this.processedMessages.delete(message.id);
+    if (handler) {
+      await this.deleteReplies(handler.replies);
     }
   }
 
-  private getPreviousMessage(message: Message): GetPreviousMessage {
-    let currMessage: Message = message;
+  async handleReaction(
+    reaction: MessageReaction | PartialMessageReaction,
+    user: User | PartialUser,
+  ): Promise<void> {
+    if (user.id === this.client.user?.id) {
+      return;
+    }
 
-    return async () => {
-      if (!currMessage.reference) {
-        return null;
+    const emoji = reaction.emoji.name?.replace(/\uFE0F/g, '');
+
+    if (
+      this.config.feedbackReactions &&
+      (emoji === UPVOTE_REACTION || emoji === DOWNVOTE_REACTION)
+    ) {
+      await this.recordVote(reaction, user, emoji === UPVOTE_REACTION);
+      return;
+    }
+
+    if (
+      this.config.continueReaction &&
+      emoji === this.config.continueReaction.replace(/\uFE0F/g, '')
+    ) {
+      await this.continueResponse(reaction, user);
+      return;
+    }
+
+    if (
+      !this.featureFlagsService.isEnabled(FeatureFlagEnum.REACTION_CONTROLS) ||
+      (emoji !== STOP_REACTION && emoji !== REGENERATE_REACTION)
+    ) {
+      return;
+    }
+
+    if (!this.acquireReaction(`${reaction.message.id}:${emoji}:${user.id}`)) {
+      return;
+    }
+
+    const reply = reaction.message.partial
+      ? await reaction.message.fetch().catch(() => null)
+      : reaction.message;
+
+    if (!reply || reply.author.id !== this.client.user?.id) {
+      return;
+    }
+
+    if (emoji === STOP_REACTION) {
+      const handlers = this.activeHandlers.find(
+        (handler) =>
+          handler.authorId === user.id && handler.replies.some(({ id }) => id === reply.id),
+      );
+
+      for (const handler of handlers) {
+        handler.abortController.abort();
       }
+      return;
+    }
 
-      currMessage = await currMessage.fetchReference();
+    const message = await this.discordUtilsService.fetchReference(reply);
 
-      return await this.getCompletionMessage(currMessage);
-    };
+    if (!message || message.author.id !== user.id) {
+      return;
+    }
+
+    const cooldown = this.acquireRegenerate(user.id);
+
+    if (cooldown) {
+      await this.sendRegenerateNotice(message, cooldown);
+      return;
+    }
+
+    await this.regenerateMessage(message, [reply]);
   }
 
-  private async getCompletionMessage(message: Message): Promise<CompletionMessage> {
-    const content = `${message.cleanContent}`;
+  private async recordVote(
+    reaction: MessageReaction | PartialMessageReaction,
+    user: User | PartialUser,
+    isPositive: boolean,
+  ): Promise<void> {
+    const reply = reaction.message.partial
+      ? await reaction.message.fetch().catch(() => null)
+      : reaction.message;
 
-    const attachments: CompletionAttachment[] = [];
+    if (!reply || reply.author.id !== this.client.user?.id) {
+      return;
+    }
 
-    for (const [, attachment] of message.attachments) {
-      try {
-        if (
-          !this.anthropicService.validateAttachment(
-            attachment.size,
-            attachment.contentType ?? undefined,
-            attachment.name,
-          )
-        ) {
-          continue;
-        }
+    await this.feedbackStore.setVote({
+      replyId: reply.id,
+      messageId: reply.reference?.messageId ?? null,
+      channelId: reply.channelId,
+      userId: user.id,
+      isPositive,
+      createdAt: new Date(),
+    });
 
-        const content = await axios
-          .get(attachment.url, {
-            responseType: 'arraybuffer',
-          })
-          .then((r) => r.data);
+    this.logger.log(
+      `Feedback ${isPositive ? 'up' : 'down'}vote on reply ${reply.id} by user ${user.id}`,
+    );
+  }
 
-        attachments.push({
-          content,
-          name: attachment.name,
-          contentType: attachment.contentType ?? undefined,
-        });
-      } catch (error) {
-        this.logger.error(error);
+  private async offerContinuation(
+    message: Message,
+    content: string,
+    replies: Message[],
+  ): Promise<void> {
+    const reply = replies.at(-1) as Message;
+
+    this.truncatedResponses.set(reply.id, { message, content: content.trimEnd(), replies });
+
+    if (this.truncatedResponses.size > MAX_TRACKED_REPLIES) {
+      this.truncatedResponses.delete(this.truncatedResponses.keys().next().value);
+    }
+
+    await reply.react(this.config.continueReaction as string).catch((error) => {
+      this.logger.warn(`Failed to add continue reaction to reply ${reply.id}: ${error}`);
+    });
+  }
+
+  // A response that was regenerated or continued can no longer be continued from its old text
+  private clearContinuation(replies: Message[]): void {
+    for (const reply of replies) {
+      if (this.truncatedResponses.delete(reply.id)) {
+        void reply.reactions.cache
+          .get(this.config.continueReaction as string)
+          ?.users.remove()
+          .catch(() => null);
       }
     }
+  }
 
-    return {
+  private async continueResponse(
+    reaction: MessageReaction | PartialMessageReaction,
+    user: User | PartialUser,
+  ): Promise<void> {
+    const truncatedResponse = this.truncatedResponses.get(reaction.message.id);
+
+    // Only the author of the prompt may continue the response
+    if (!truncatedResponse || truncatedResponse.message.author.id !== user.id) {
+      return;
+    }
+
+    const { message, content, replies } = truncatedResponse;
+
+    this.clearContinuation(replies);
+
+    await this.createMessage(message, replies, content);
+  }
+
+  private async addFeedbackReactions(reply: Message): Promise<void> {
+    try {
+      await reply.react(UPVOTE_REACTION);
+      await reply.react(DOWNVOTE_REACTION);
+    } catch (error) {
+      this.logger.warn(`Failed to add feedback reactions to reply ${reply.id}: ${error}`);
+    }
+  }
+
+  // Returns the seconds left until the user may regenerate again, or 0 when they can now
+  private acquireRegenerate(userId: string): number {
+    if (!this.config.regenerateCooldown) {
+      return 0;
+    }
+
+    const now = Date.now();
+
+    for (const [cooldownUserId, expiresAt] of this.regenerateCooldowns) {
+      if (expiresAt <= now) {
+        this.regenerateCooldowns.delete(cooldownUserId);
+      }
+    }
+
+    const expiresAt = this.regenerateCooldowns.get(userId);
+
+    if (expiresAt) {
+      return Math.ceil((expiresAt - now) / 1000);
+    }
+
+    this.regenerateCooldowns.set(userId, now + this.config.regenerateCooldown * 1000);
+
+    return 0;
+  }
+
+  private async sendRegenerateNotice(message: Message, cooldown: number): Promise<void> {
+    const notice = await message
+      .reply({
+        content: `Подожди ${cooldown} сек. перед повторной генерацией ⏳`,
+        allowedMentions: this.discordUtilsService.getAllowedMentions(message.guildId),
+      })
+      .catch((error) => {
+        this.logger.warn(`Cannot send regenerate cooldown notice: ${error}`);
+        return null;
+      });
+
+    setTimeout(() => notice?.delete().catch(() => null), REGENERATE_NOTICE_TTL);
+  }
+
+  private acquireReaction(key: string): boolean {
+    const now = Date.now();
+
+    for (const [handledKey, expiresAt] of this.handledReactions) {
+      if (expiresAt <= now) {
+        this.handledReactions.delete(handledKey);
+      }
+    }
+
+    if (this.handledReactions.has(key)) {
+      return false;
+    }
+
+    this.handledReactions.set(key, now + REACTION_DEDUP_TTL);
+
+    return true;
+  }
+
+  private async sendFallbackReply(
+    message: Message,
+    content: string,
+    replies: Message[],
+    config: DiscordConfig,
+  ): Promise<Message[]> {
+    this.logger.warn(`Editing replies to message ${message.id} keeps failing, sending a new one`);
+
+    const reply = await this.discordUtilsService.sendFallbackMessage(message, content, config);
+
+    await this.deleteReplies(replies);
+
+    return [reply];
+  }
+
+  // Replying in the channel is impossible, so tell the author in DMs instead, and log the channel
+  // only once to keep the logs readable
+  private canReply(message: Message): boolean {
+    const expiresAt = this.forbiddenChannels.get(message.channelId);
+
+    if (expiresAt !== undefined) {
+      if (expiresAt > Date.now()) {
+        return false;
+      }
+
+      this.forbiddenChannels.delete(message.channelId);
+    }
+
+    if (!message.inGuild() || !this.client.user) {
+      return true;
+    }
+
+    const permissions = message.channel.permissionsFor(this.client.user);
+    const sendPermission = message.channel.isThread()
+      ? PermissionFlagsBits.SendMessagesInThreads
+      : PermissionFlagsBits.SendMessages;
+
+    // Unknown permissions are not a reason to stay silent, a failed reply is handled anyway
+    return !permissions || permissions.has([PermissionFlagsBits.ViewChannel, sendPermission]);
+  }
+
+  private async handlePermissionError(message: Message): Promise<void> {
+    // Not extended by the prompts it rejects, so the permissions are checked again on expiry
+    if (!this.forbiddenChannels.has(message.channelId)) {
+      this.forbiddenChannels.set(message.channelId, Date.now() + FORBIDDEN_CHANNEL_TTL);
+      this.logger.warn(`Missing permissions to reply in channel ${message.channelId}`);
+    }
+
+    if (message.guildId === null) {
+      return;
+    }
+
+    const notifiedAt = this.permissionNotices.get(message.author.id);
+
+    if (notifiedAt !== undefined && Date.now() - notifiedAt < PERMISSION_NOTICE_INTERVAL) {
+      return;
+    }
+
+    this.permissionNotices.set(message.author.id, Date.now());
+
+    await message.author
+      .send(
+        `Я не могу отвечать в канале ${message.channel}: не хватает прав. ` +
+          'Сообщи об этом администраторам сервера',
+      )
+      .catch((error) => {
+        this.logger.warn(
+          `Cannot notify user ${message.author.id} about missing permissions: ${error}`,
+        );
+      });
+  }
+
+  private async deleteReplies(replies: Message[]): Promise<void> {
+    for (const reply of replies) {
+      await reply.delete().catch((error) => this.logger.error(error));
+    }
+  }
+
+  isActiveConversation(message: Message): boolean {
+    return !!this.getActiveConversation(message);
+  }
+
+  private getActiveConversation(message: Message): ActiveConversation | null {
+    if (!this.featureFlagsService.isEnabled(FeatureFlagEnum.CONVERSATION_CONTINUATION)) {
+      return null;
+    }
+
+    const key = this.getConversationKey(message);
+    const conversation = this.activeConversations.get(key);
+
+    if (!conversation) {
+      return null;
+    }
+
+    if (conversation.expiresAt <= Date.now()) {
+      this.activeConversations.delete(key);
+      return null;
+    }
+
+    return conversation;
+  }
+
+  private setActiveConversation(message: Message, reply: Message): void {
+    if (!this.config.conversationTimeout) {
+      return;
+    }
+
+    const now = Date.now();
+
+    for (const [key, conversation] of this.activeConversations) {
+      if (conversation.expiresAt <= now) {
+        this.activeConversations.delete(key);
+      }
+    }
+
+    this.activeConversations.set(this.getConversationKey(message), {
+      replyId: reply.id,
+      expiresAt: now + this.config.conversationTimeout * 1000,
+    });
+  }
+
+  // Threads have their own channel ids, so one user can hold separate conversations in
+  // several threads of the same channel without their contexts bleeding into each other.
+  private getConversationKey(message: Message): string {
+    return `${message.channelId}:${message.author.id}`;
+  }
+
+  private hashPrompt(
+    message: CompletionMessage,
+    preferences: CompletionPreferences,
+    systemMessage?: string,
+    context?: string,
+  ): string {
+    const hash = createHash('sha256')
+      .update(JSON.stringify([message.content, preferences, systemMessage, context]))
+      .update(message.role);
+
+    for (const attachment of message.attachments ?? []) {
+      hash.update(attachment.content);
+    }
+
+    return hash.digest('hex');
+  }
+
+  private getRecentResponse(message: Message, promptHash: string): string | null {
+    const key = this.getConversationKey(message);
+    const recentResponse = this.recentResponses.get(key);
+
+    if (!recentResponse || recentResponse.expiresAt <= Date.now()) {
+      this.recentResponses.delete(key);
+      return null;
+    }
+
+    return recentResponse.promptHash === promptHash ? recentResponse.content : null;
+  }
+
+  private setRecentResponse(message: Message, promptHash: string, content: string): void {
+    const now = Date.now();
+
+    for (const [key, recentResponse] of this.recentResponses) {
+      if (recentResponse.expiresAt <= now) {
+        this.recentResponses.delete(key);
+      }
+    }
+
+    this.recentResponses.set(this.getConversationKey(message), {
+      promptHash,
       content,
+      expiresAt: now + (this.config.duplicateResponseWindow ?? 0) * 1000,
+    });
+  }
+
+  private async getPreferences(
+    userId: string,
+    guildId: string | null,
+  ): Promise<CompletionPreferences> {
+    const guildConfig = this.discordUtilsService.getGuildConfig(guildId);
+
+    const preferences = {
+      verbosity: guildConfig.verbosity,
+      language: guildConfig.responseLanguage,
+      ...(await this.userPrefsStore.get(userId)),
+    };
+
+    if (
+      preferences.model &&
+      !this.discordUtilsService.getAllowedModels(guildId).includes(preferences.model)
+    ) {
+      delete preferences.model;
+    }
+
+    return preferences;
+  }
+
+  private getPreviousMessage(message: Message): GetPreviousMessage {
+    const getHistoryMessage = this.getHistoryMessage(message);
+
+    return async () => {
+      const previousMessage = await getHistoryMessage();
+
+      return previousMessage ? await this.getCompletionMessage(previousMessage, true) : null;
+    };
+  }
+
+  // A merged turn is sent as a single prompt
+  private async getPromptMessage(message: Message): Promise<CompletionMessage> {
+    const merged = this.mergedMessages.get(message.id);
+
+    if (!merged) {
+      return await this.getCompletionMessage(message);
+    }
+
+    const completionMessages = await Promise.all(
+      [...merged, message].map((mergedMessage) => this.getCompletionMessage(mergedMessage)),
+    );
+
+    return {
+      role: MessageRoleEnum.USER,
+      content: completionMessages
+        .map(({ content }) => content)
+        .filter(Boolean)
+        .join('\n'),
+      attachments: completionMessages.flatMap(({ attachments }) => attachments ?? []),
+    };
+  }
+
+  // The history of a merged turn starts before its first message
+  private getPromptHistory(message: Message): GetPreviousMessage {
+    return this.getPreviousMessage(this.mergedMessages.get(message.id)?.[0] ?? message);
+  }
+
+  // Walks the conversation of a message back from the newest to the oldest message
+  private getHistoryMessage(message: Message): () => Promise<Message | null> {
+    if (
+      message.guildId === null &&
+      this.config.dmHistoryMessages &&
+      !message.reference &&
+      !this.getActiveConversation(message)
+    ) {
+      return this.getDmHistoryMessage(message);
+    }
+
+    let currMessage: Message = message;
+    let isStarterFetched = false;
+
+    return async () => {
+      const conversation = currMessage === message ? this.getActiveConversation(message) : null;
+
+      let previousMessage = currMessage.reference
+        ? await this.discordUtilsService.fetchReference(currMessage)
+        : conversation
+          ? await message.channel.messages.fetch(conversation.replyId).catch(() => null)
+          : null;
+
+      // The message a thread was started from holds the actual prompt: it lives outside the
+      // thread for regular threads and is the opening post for forum ones
+      if (
+        !previousMessage &&
+        !isStarterFetched &&
+        currMessage.id !== message.channelId &&
+        message.channel.isThread() &&
+        this.config.threadStarterContext !== false
+      ) {
+        isStarterFetched = true;
+        previousMessage = await message.channel.fetchStarterMessage().catch(() => null);
+      }
+
+      if (!previousMessage) {
+        return null;
+      }
+
+      currMessage = previousMessage;
+
+      return currMessage;
+    };
+  }
+
+  // DMs rarely use replies, so without a reference the recent DM messages become the history
+  private getDmHistoryMessage(message: Message): () => Promise<Message | null> {
+    let history: Message[] | null = null;
+
+    return async () => {
+      history ??= await this.fetchDmHistory(message);
+
+      return history.shift() ?? null;
+    };
+  }
+
+  private async fetchDmHistory(message: Message): Promise<Message[]> {
+    const window = (this.config.dmHistoryWindow ?? DEFAULT_DM_HISTORY_WINDOW) * 1000;
+
+    const messages = await message.channel.messages
+      .fetch({ limit: this.config.dmHistoryMessages, before: message.id })
+      .catch((error) => {
+        this.logger.warn(`Cannot fetch DM history for message ${message.id}: ${error}`);
+        return null;
+      });
+
+    const history: Message[] = [];
+
+    let nextTimestamp = message.createdTimestamp;
+
+    // Fetched messages are ordered from the newest to the oldest, and a long enough pause
+    // between two of them ends the conversation
+    for (const previousMessage of messages?.values() ?? []) {
+      if (nextTimestamp - previousMessage.createdTimestamp > window) {
+        break;
+      }
+
+      history.push(previousMessage);
+      nextTimestamp = previousMessage.createdTimestamp;
+    }
+
+    return history;
+  }
+
+  private async getCompletionMessage(
+    message: Message,
+    isHistory: boolean = false,
+  ): Promise<CompletionMessage> {
+    // The prompt is always a user turn, otherwise the request would end with an assistant turn,
+    // which the API continues instead of answering
+    const role = isHistory ? this.getMessageRole(message) : MessageRoleEnum.USER;
+
+    const content: string[] = [this.sanitizeContent(this.getMessageText(message))];
+
+    if (role === MessageRoleEnum.USER && this.config.userNamePrefix) {
+      content[0] =
+        `${message.member?.displayName ?? message.author.displayName}: ${content[0]}`.trimEnd();
+    }
+
+    if (this.config.annotateAssistants && this.isForeignAssistant(message)) {
+      content[0] = `[${message.author.displayName}, another assistant]: ${content[0]}`.trimEnd();
+    }
+
+    if (isHistory && this.config.historyTimestamps) {
+      content[0] = `[${this.formatTimestamp(message.createdAt)}] ${content[0]}`.trimEnd();
+    }
+
+    if (!isHistory) {
+      const urlContext = await this.urlContextService.getContext(message.content);
+
+      content.push(...urlContext.map((context) => this.sanitizeContent(context)));
+
+      if (this.config.mentionPolicy === MentionPolicyEnum.CONTEXT) {
+        const mentionContext = await this.getMentionContext(message);
+
+        content.push(...mentionContext.map((context) => this.sanitizeContent(context)));
+      }
+
+      const reactionContext = this.config.reactionContext ? this.getReactionContext(message) : null;
+
+      if (reactionContext) {
+        content.push(this.sanitizeContent(reactionContext));
+      }
+    }
+
+    content.push(...this.getEmbedContext(message).map((context) => this.sanitizeContent(context)));
+
+    const attachments: CompletionAttachment[] = [];
+
+    const validAttachments = [...message.attachments.values()].filter((attachment) =>
+      this.anthropicService.validateAttachment(
+        attachment.size,
+        attachment.contentType ?? undefined,
+        attachment.name,
+      ),
+    );
+
+    const maxAttachments = this.config.maxAttachmentsPerMessage ?? validAttachments.length;
+
+    if (validAttachments.length > maxAttachments) {
+      content.push(`(${validAttachments.length - maxAttachments} more attachments skipped)`);
+    }
+
+    const { textEncoding } = this.discordUtilsService.getGuildConfig(message.guildId);
+
+    const downloadedAttachments = await mapConcurrently(
+      validAttachments.slice(0, maxAttachments),
+      this.config.attachmentsConcurrency ?? 4,
+      async (attachment): Promise<CompletionAttachment | null> => {
+        try {
+          return {
+            content: await this.downloadAttachment(attachment.url, this.getAttachmentSignal()),
+            name: attachment.name,
+            contentType: attachment.contentType ?? undefined,
+            encoding: textEncoding,
+          };
+        } catch (error) {
+          this.logger.error(error);
+          return null;
+        }
+      },
+    );
+
+    for (const attachment of downloadedAttachments) {
+      if (attachment) {
+        attachments.push(attachment);
+      }
+    }
+
+    for (const [, sticker] of message.stickers) {
+      content.push(`(sticker: ${sticker.name})`);
+
+      if (
+        sticker.format !== StickerFormatType.PNG ||
+        !this.featureFlagsService.isEnabled(FeatureFlagEnum.STICKER_IMAGES)
+      ) {
+        continue;
+      }
+
+      try {
+        const stickerContent = await this.downloadAttachment(
+          sticker.url,
+          this.getAttachmentSignal(),
+        );
+
+        if (
+          this.anthropicService.validateAttachment(
+            stickerContent.length,
+            'image/png',
+            `${sticker.name}.png`,
+          )
+        ) {
+          attachments.push({
+            content: stickerContent,
+            name: `${sticker.name}.png`,
+            contentType: 'image/png',
+          });
+        }
+      } catch (error) {
+        this.logger.error(error);
+      }
+    }
+
+    return {
+      content: content.filter(Boolean).join('\n'),
       attachments,
-      role:
-        message.author.id === this.client.user?.id
-          ? MessageRoleEnum.ASSISTANT
-          : MessageRoleEnum.USER,
+      role,
+    };
+  }
+
+  private stripPrefixes(content: string): string {
+    let result = content;
+    let prefix: string | undefined;
+
+    do {
+      prefix = this.config.strippedPrefixes?.find((value) =>
+        result.trimStart().toLowerCase().startsWith(value.toLowerCase()),
+      );
+
+      if (prefix) {
+        result = result.trimStart().slice(prefix.length).replace(/^[\s,.:;!—-]+/, '');
+      }
+    } while (prefix && result);
+
+    return result;
+  }
+
+  private getTemplateData(message: Message): PromptTemplateData {
+    const { channel, guild } = message;
+
+    return {
+      bot: {
+        name: guild?.members.me?.displayName ?? this.client.user?.displayName ?? '',
+      },
+      user: {
+        id: message.author.id,
+        name: message.member?.displayName ?? message.author.displayName,
+      },
+      guild: guild ? { name: guild.name } : undefined,
+      channel: 'name' in channel && channel.name ? { name: channel.name } : undefined,
+      locale: guild?.preferredLocale,
     };
   }
+
+  private getMessageRole(message: Message): MessageRoleEnum {
+    return message.author.id === this.client.user?.id || this.isForeignAssistant(message)
+      ? MessageRoleEnum.ASSISTANT
+      : MessageRoleEnum.USER;
+  }
+
+  isForeignAssistant(message: Message): boolean {
+    return !!this.config.assistantIds?.some(
+      (id) => id === message.author.id || id === message.webhookId,
+    );
+  }
+
+  private getMessageText(message: Message): string {
+    // Our own replies may carry a quote of the prompt, the reply prefix and suffix, notes and the
+    // usage footer, which the model must not repeat
+    if (message.author.id === this.client.user?.id) {
+      return this.discordUtilsService
+        .stripReplyDecorations(message.cleanContent)
+        .replace(USAGE_FOOTER_PATTERN, '');
+    }
+
+    const isStripPolicy = this.config.mentionPolicy === MentionPolicyEnum.STRIP;
+
+    if (!isStripPolicy && !this.config.stripBotMention) {
+      return message.cleanContent;
+    }
+
+    // Mentions of the bot itself stay by default, so the model still knows it was addressed
+    const content = message.content
+      .replace(USER_MENTION_PATTERN, (mention, userId) =>
+        (userId === this.client.user?.id ? this.config.stripBotMention : isStripPolicy)
+          ? ''
+          : mention,
+      )
+      .replace(/[^\S\n]{2,}/g, ' ')
+      .trim();
+
+    return cleanContent(content, message.channel);
+  }
+
+  private formatUsageFooter({ model, inputTokens, outputTokens }: TokenUsage): string {
+    const footer =
+      `${USAGE_FOOTER_PREFIX}Токены: ${inputTokens} на входе, ${outputTokens} на выходе`;
+    const price = this.config.modelPrices?.[model];
+
+    if (!price) {
+      return footer;
+    }
+
+    const cost = (inputTokens * price.input + outputTokens * price.output) / 1_000_000;
+
+    return `${footer} · ≈ $${cost.toFixed(4)}`;
+  }
+
+  private findMacro(message: Message): MacroConfig | null {
+    const prompt = message.content
+      .replace(USER_MENTION_PATTERN, (mention, userId) =>
+        userId === this.client.user?.id ? '' : mention,
+      )
+      .replace(/\s+/g, ' ')
+      .trim();
+
+    const macro = this.config.macros?.find((macro) =>
+      macro.text !== undefined
+        ? macro.text.trim().toLowerCase() === prompt.toLowerCase()
+        : this.getMacroPattern(macro).test(prompt),
+    );
+
+    return macro ?? null;
+  }
+
+  // A reload replaces the macros with new objects, so each pattern is compiled once per config
+  private getMacroPattern(macro: MacroConfig): RegExp {
+    let pattern = this.macroPatterns.get(macro);
+
+    if (!pattern) {
+      pattern = new RegExp(`${macro.pattern}`, 'i');
+      this.macroPatterns.set(macro, pattern);
+    }
+
+    return pattern;
+  }
+
+  // Replies never ping everyone thanks to allowedMentions, the policy decides whether such prompts
+  // are answered at all
+  private isMassMentionAttempt(message: Message): boolean {
+    return MASS_MENTION_PATTERNS.some((pattern) => pattern.test(message.content));
+  }
+
+  private async getMentionContext(message: Message): Promise<string[]> {
+    const users = message.mentions.users.filter(
+      (user) => user.id !== message.author.id && user.id !== this.client.user?.id,
+    );
+
+    if (!users.size) {
+      return [];
+    }
+
+    const recentMessages = await message.channel.messages
+      .fetch({ limit: MENTION_CONTEXT_LOOKBACK, before: message.id })
+      .catch((error) => {
+        this.logger.warn(`Cannot fetch recent messages in channel ${message.channelId}: ${error}`);
+        return null;
+      });
+
+    if (!recentMessages) {
+      return [];
+    }
+
+    const context: string[] = [];
+
+    for (const [userId, user] of users) {
+      // Fetched messages are ordered from the newest to the oldest
+      const userMessages = [...recentMessages.values()]
+        .filter((recentMessage) => recentMessage.author.id === userId && recentMessage.cleanContent)
+        .slice(0, MENTION_CONTEXT_MESSAGES)
+        .reverse();
+
+      if (!userMessages.length) {
+        continue;
+      }
+
+      const name = message.mentions.members?.get(userId)?.displayName ?? user.displayName;
+
+      context.push(
+        `Recent messages from ${name}:\n` +
+          userMessages.map((userMessage) => userMessage.cleanContent).join('\n'),
+      );
+    }
+
+    return context;
+  }
+
+  // Only the most used emojis are listed, the bot's own reactions are not counted
+  private getReactionContext(message: Message): string | null {
+    const reactions = message.reactions.cache
+      .map((reaction) => ({
+        emoji: reaction.emoji.id ? `:${reaction.emoji.name}:` : reaction.emoji.name,
+        count: reaction.count - (reaction.me ? 1 : 0),
+      }))
+      .filter(({ emoji, count }) => emoji && count > 0)
+      .sort((a, b) => b.count - a.count)
+      .slice(0, MAX_REACTION_CONTEXT_EMOJIS);
+
+    if (!reactions.length) {
+      return null;
+    }
+
+    return `Reactions on this message: ${reactions
+      .map(({ emoji, count }) => `${emoji} × ${count}`)
+      .join(', ')}`;
+  }
+
+  private getEmbedContext(message: Message): string[] {
+    // Our own embeds carry the reply itself, their author and title only repeat the prompt
+    if (message.author.id === this.client.user?.id) {
+      return message.embeds.map(({ description }) => description ?? '').filter(Boolean);
+    }
+
+    return message.embeds.flatMap((embed) => {
+      const text = [
+        embed.author?.name,
+        embed.title,
+        embed.description,
+        ...embed.fields.map(({ name, value }) => `${name}: ${value}`),
+        embed.footer?.text,
+      ]
+        .filter(Boolean)
+        .join('\n');
+
+      if (!text) {
+        return [];
+      }
+
+      return text.length > MAX_EMBED_CONTEXT_LENGTH
+        ? [`(embed)\n${splitText(text, MAX_EMBED_CONTEXT_LENGTH)[0]}…`]
+        : [`(embed)\n${text}`];
+    });
+  }
+
+  private sanitizeContent(content: string): string {
+    const policy = this.config.promptSanitization ?? PromptSanitizationEnum.FORMAT;
+
+    if (policy === PromptSanitizationEnum.NONE) {
+      return content;
+    }
+
+    return sanitizeText(content, {
+      format: policy === PromptSanitizationEnum.FORMAT,
+    });
+  }
+
+  private formatTimestamp(date: Date): string {
+    if (this.config.historyTimestamps === HistoryTimestampsEnum.RELATIVE) {
+      return formatDistanceToNow(date, { addSuffix: true });
+    }
+
+    return format(date, 'yyyy-MM-dd HH:mm');
+  }
+
+  // Bounds the download of one attachment including its retries, so a stalled one is dropped
+  // without holding up the others
+  private getAttachmentSignal(): AbortSignal {
+    return AbortSignal.timeout(this.config.attachmentTimeout ?? DEFAULT_ATTACHMENT_TIMEOUT);
+  }
+
+  private async downloadAttachment(url: string, signal?: AbortSignal): Promise<Buffer> {
+    const retries = this.config.downloadRetries ?? 2;
+
+    for (let attempt = 0; ; attempt++) {
+      try {
+        return await axios
+          .get(url, {
+            responseType: 'arraybuffer',
+            timeout: 30000,
+            signal,
+          })
+          .then((r) => Buffer.from(r.data));
+      } catch (error) {
+        if (signal?.aborted) {
+          this.logger.warn(`Attachment ${url} timed out, skipping`);
+          throw error;
+        }
+
+        const status = axios.isAxiosError(error) ? error.response?.status : undefined;
+
+        if (status && status < 500 && status !== 429) {
+          this.logger.warn(`Attachment ${url} is unavailable (${status}), not retrying`);
+          throw error;
+        }
+
+        if (attempt >= retries) {
+          this.logger.warn(`Attachment ${url} failed after ${attempt + 1} attempts`);
+          throw error;
+        }
+
+        this.logger.warn(`Transient error downloading ${url}, retrying (${attempt + 1}): ${error}`);
+
+        await sleep(DOWNLOAD_RETRY_DELAY * 2 ** attempt);
+      }
+    }
+  }
 }
@@ -0,0 +1,9 @@
+import { Param } from '@discord-nestjs/core';
+
+export class ExportCommandDto {
+  @Param({
+    description: 'Ссылка на последнее сообщение разговора или его ID',
+    required: true,
+  })
+  message: string;
+}
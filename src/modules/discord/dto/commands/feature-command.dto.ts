@@ -0,0 +1,18 @@
+import { Choice, Param } from '@discord-nestjs/core';
+
+import { FeatureFlagEnum } from '../enum';
+
+export class FeatureCommandDto {
+  @Choice(FeatureFlagEnum)
+  @Param({
+    description: 'Флаг',
+    required: false,
+  })
+  flag?: FeatureFlagEnum;
+
+  @Param({
+    description: 'Включить или выключить',
+    required: false,
+  })
+  enabled?: boolean;
+}
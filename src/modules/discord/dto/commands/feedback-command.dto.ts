@@ -0,0 +1,15 @@
+import { Param } from '@discord-nestjs/core';
+
+export class FeedbackCommandDto {
+  @Param({
+    description: 'Отзыв',
+    required: true,
+  })
+  text: string;
+
+  @Param({
+    description: 'Ссылка на ответ бота или его ID, по умолчанию последний ответ в канале',
+    required: false,
+  })
+  message?: string;
+}
@@ -0,0 +1,7 @@
+export * from './export-command.dto';
+export * from './feature-command.dto';
+export * from './feedback-command.dto';
+export * from './maintenance-command.dto';
+export * from './prefs-command.dto';
+export * from './replay-command.dto';
+export * from './tokens-command.dto';
@@ -0,0 +1,9 @@
+import { Param } from '@discord-nestjs/core';
+
+export class MaintenanceCommandDto {
+  @Param({
+    description: 'Включить или выключить',
+    required: false,
+  })
+  enabled?: boolean;
+}
@@ -0,0 +1,31 @@
+import { Choice, Param } from '@discord-nestjs/core';
+
+import { VerbosityEnum } from '../../../anthropic';
+
+export class PrefsCommandDto {
+  @Param({
+    description: 'Модель по умолчанию',
+    required: false,
+    autocomplete: true,
+  })
+  model?: string;
+
+  @Choice(VerbosityEnum)
+  @Param({
+    description: 'Подробность ответов',
+    required: false,
+  })
+  verbosity?: VerbosityEnum;
+
+  @Param({
+    description: 'Язык ответов',
+    required: false,
+  })
+  language?: string;
+
+  @Param({
+    description: 'Сбросить настройки',
+    required: false,
+  })
+  reset?: boolean;
+}
@@ -0,0 +1,9 @@
+import { Param } from '@discord-nestjs/core';
+
+export class TokensCommandDto {
+  @Param({
+    description: 'Ссылка на сообщение или его ID',
+    required: true,
+  })
+  message: string;
+}
@@ -0,0 +1,5 @@
+export enum FeatureFlagEnum {
+  STICKER_IMAGES = 'sticker_images',
+  CONVERSATION_CONTINUATION = 'conversation_continuation',
+  REACTION_CONTROLS = 'reaction_controls',
+}
@@ -0,0 +1,4 @@
+export enum HistoryTimestampsEnum {
+  RELATIVE = 'relative',
+  ABSOLUTE = 'absolute',
+}
@@ -0,0 +1,6 @@
+export * from './history-timestamps.enum';
+export * from './response-format.enum';
+export * from './prompt-sanitization.enum';
+export * from './feature-flag.enum';
+export * from './mention-policy.enum';
+export * from './mass-mention-policy.enum';
@@ -0,0 +1,5 @@
+export enum MassMentionPolicyEnum {
+  ALLOW = 'allow',
+  WARN = 'warn',
+  REFUSE = 'refuse',
+}
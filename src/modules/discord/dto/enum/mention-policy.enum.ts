@@ -0,0 +1,5 @@
+export enum MentionPolicyEnum {
+  NAME = 'name',
+  STRIP = 'strip',
+  CONTEXT = 'context',
+}
@@ -0,0 +1,5 @@
+export enum PromptSanitizationEnum {
+  NONE = 'none',
+  CONTROL = 'control',
+  FORMAT = 'format',
+}
@@ -0,0 +1,4 @@
+export enum ResponseFormatEnum {
+  MESSAGE = 'message',
+  EMBED = 'embed',
+}
@@ -0,0 +1,33 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { DiscordConfigStore } from './discord.config';
+import { FeatureFlagEnum } from './dto/enum';
+import { FeatureFlagsService } from './feature-flags.service';
+
+describe('FeatureFlagsService', () => {
+  it('leaves every flag off by default', () => {
+    const service = new FeatureFlagsService(new DiscordConfigStore({ botToken: 'token' }));
+
+    assert.ok(Object.values(service.getFlags()).every((enabled) => !enabled));
+  });
+
+  it('enables the flags listed in the config', () => {
+    const service = new FeatureFlagsService(
+      new DiscordConfigStore({ botToken: 'token', features: [FeatureFlagEnum.STICKER_IMAGES] }),
+    );
+
+    assert.ok(service.isEnabled(FeatureFlagEnum.STICKER_IMAGES));
+    assert.ok(!service.isEnabled(FeatureFlagEnum.REACTION_CONTROLS));
+  });
+
+  it('toggles a flag at runtime', () => {
+    const service = new FeatureFlagsService(new DiscordConfigStore({ botToken: 'token' }));
+
+    service.setEnabled(FeatureFlagEnum.REACTION_CONTROLS, true);
+    assert.ok(service.isEnabled(FeatureFlagEnum.REACTION_CONTROLS));
+
+    service.setEnabled(FeatureFlagEnum.REACTION_CONTROLS, false);
+    assert.ok(!service.isEnabled(FeatureFlagEnum.REACTION_CONTROLS));
+  });
+});
@@ -0,0 +1,36 @@
+import { Inject, Injectable } from '@nestjs/common';
+
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
+import { FeatureFlagEnum } from './dto/enum';
+
+@Injectable()
+export class FeatureFlagsService {
+  private readonly flags: Map<FeatureFlagEnum, boolean> = new Map();
+
+  constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+  ) {
+    for (const flag of this.config.features ?? []) {
+      this.flags.set(flag, true);
+    }
+  }
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  isEnabled(flag: FeatureFlagEnum): boolean {
+    return this.flags.get(flag) ?? false;
+  }
+
+  setEnabled(flag: FeatureFlagEnum, enabled: boolean): void {
+    this.flags.set(flag, enabled);
+  }
+
+  getFlags(): Record<FeatureFlagEnum, boolean> {
+    return Object.fromEntries(
+      Object.values(FeatureFlagEnum).map((flag) => [flag, this.isEnabled(flag)]),
+    ) as Record<FeatureFlagEnum, boolean>;
+  }
+}
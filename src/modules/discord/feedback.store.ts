@@ -0,0 +1,45 @@
+import { Injectable } from '@nestjs/common';
+
+export interface FeedbackVote {
+  replyId: string;
+  // The prompt the reply answers, it identifies the conversation
+  messageId: string | null;
+  channelId: string;
+  userId: string;
+  isPositive: boolean;
+  createdAt: Date;
+}
+
+export interface FeedbackNote {
+  replyId: string | null;
+  channelId: string;
+  userId: string;
+  text: string;
+  createdAt: Date;
+}
+
+export abstract class FeedbackStore {
+  // A repeated vote of the same user on the same reply replaces the previous one
+  abstract setVote(vote: FeedbackVote): Promise<void>;
+  abstract getVotes(replyId: string): Promise<FeedbackVote[]>;
+  abstract addNote(note: FeedbackNote): Promise<void>;
+}
+
+@Injectable()
+export class InMemoryFeedbackStore extends FeedbackStore {
+  private readonly votes: Map<string, FeedbackVote> = new Map();
+
+  private readonly notes: FeedbackNote[] = [];
+
+  async setVote(vote: FeedbackVote): Promise<void> {
+    this.votes.set(`${vote.replyId}:${vote.userId}`, vote);
+  }
+
+  async getVotes(replyId: string): Promise<FeedbackVote[]> {
+    return [...this.votes.values()].filter((vote) => vote.replyId === replyId);
+  }
+
+  async addNote(note: FeedbackNote): Promise<void> {
+    this.notes.push(note);
+  }
+}
@@ -1,2 +1,3 @@
 export * from './discord.module';
 export * from './discord.config';
+export * from './dto/enum';
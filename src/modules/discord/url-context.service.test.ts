@@ -0,0 +1,56 @@
+import { strict as assert } from 'assert';
+import axios from 'axios';
+import { describe, it } from 'node:test';
+
+import { DiscordConfigStore } from './discord.config';
+import { UrlContextService } from './url-context.service';
+
+const setup = () =>
+  new UrlContextService(
+    new DiscordConfigStore({ botToken: 'token', urlContextDomains: ['example.com'] }),
+  );
+
+// Serves robots.txt disallowing /private and a text page for any other path
+const createSite = () => {
+  const requests: string[] = [];
+
+  const get = async (url: string) => {
+    requests.push(url);
+
+    return url.endsWith('/robots.txt')
+      ? { status: 200, headers: {}, data: 'User-agent: *\nDisallow: /private' }
+      : { status: 200, headers: { 'content-type': 'text/plain' }, data: `Page ${url}` };
+  };
+
+  return { requests, get };
+};
+
+describe('UrlContextService', () => {
+  it('fetches the pages of allowed domains that robots.txt does not disallow', async (t) => {
+    const { requests, get } = createSite();
+    const service = setup();
+
+    t.mock.method(axios, 'get', get);
+
+    const context = await service.getContext(
+      'https://example.com/public https://example.com/private/page https://other.com/page',
+    );
+
+    assert.deepEqual(context, [
+      'Content of https://example.com/public:\n\nPage https://example.com/public',
+    ]);
+    assert.deepEqual(requests, ['https://example.com/robots.txt', 'https://example.com/public']);
+  });
+
+  it('fetches robots.txt of an origin once', async (t) => {
+    const { requests, get } = createSite();
+    const service = setup();
+
+    t.mock.method(axios, 'get', get);
+
+    await service.getContext('https://example.com/a https://example.com/b');
+    await service.getContext('https://example.com/c');
+
+    assert.equal(requests.filter((url) => url.endsWith('/robots.txt')).length, 1);
+  });
+});
@@ -0,0 +1,204 @@
+import { Inject, Injectable, Logger } from '@nestjs/common';
+import axios, { AxiosResponse } from 'axios';
+
+import { Cache, InMemoryCache } from '../../common/cache';
+import { extractHtmlText } from '../../utils';
+
+import { DiscordConfig, DiscordConfigStore } from './discord.config';
+
+const URL_PATTERN = /https?:\/\/[^\s<>]+[^\s<>.,:;!?)'"]/g;
+
+const MAX_URLS_PER_MESSAGE = 3;
+
+const MAX_RESPONSE_SIZE = 1024 * 1024;
+
+const USER_AGENT = 'ai-discord-bot';
+
+const MAX_REDIRECTS = 3;
+
+const MAX_CACHED_ROBOTS = 1000;
+
+const ROBOTS_TTL = 24 * 60 * 60 * 1000;
+
+@Injectable()
+export class UrlContextService {
+  private readonly logger = new Logger(UrlContextService.name);
+
+  // Disallowed paths by origin, refetched once a day so that a site can change its rules
+  private readonly robots: Cache<string[]> = new InMemoryCache(MAX_CACHED_ROBOTS, ROBOTS_TTL);
+
+  private readonly pendingRobots: Map<string, Promise<string[]>> = new Map();
+
+  constructor(
+    @Inject(DiscordConfigStore)
+    private configStore: DiscordConfigStore,
+  ) {}
+
+  private get config(): DiscordConfig {
+    return this.configStore.get();
+  }
+
+  async getContext(content: string): Promise<string[]> {
+    if (!this.config.urlContextDomains?.length) {
+      return [];
+    }
+
+    const urls = [...new Set(content.match(URL_PATTERN) ?? [])]
+      .map((url) => this.parseUrl(url))
+      .filter((url): url is URL => !!url && this.isAllowedDomain(url))
+      .slice(0, MAX_URLS_PER_MESSAGE);
+
+    const result = await Promise.all(
+      urls.map(async (url) => {
+        try {
+          if (!(await this.isAllowedByRobots(url))) {
+            this.logger.log(`Skipping ${url.href}: disallowed by robots.txt`);
+            return null;
+          }
+
+          const text = await this.fetchText(url);
+
+          return text ? `Content of ${url.href}:\n\n${text}` : null;
+        } catch (error) {
+          this.logger.warn(`Cannot fetch ${url.href}: ${error}`);
+          return null;
+        }
+      }),
+    );
+
+    return result.filter((context): context is string => !!context);
+  }
+
+  private parseUrl(url: string, base?: URL): URL | null {
+    try {
+      return new URL(url, base);
+    } catch (error) {
+      return null;
+    }
+  }
+
+  private isAllowedDomain(url: URL): boolean {
+    return !!this.config.urlContextDomains?.some(
+      (domain) => url.hostname === domain || url.hostname.endsWith(`.${domain}`),
+    );
+  }
+
+  private async isAllowedByRobots(url: URL): Promise<boolean> {
+    const disallowedPaths =
+      (await this.robots.get(url.origin)) ?? (await this.loadDisallowedPaths(url.origin));
+
+    return !disallowedPaths.some((path) => url.pathname.startsWith(path));
+  }
+
+  private async loadDisallowedPaths(origin: string): Promise<string[]> {
+    const pending = this.pendingRobots.get(origin);
+
+    if (pending) {
+      return await pending;
+    }
+
+    const fetching = this.fetchDisallowedPaths(origin);
+    this.pendingRobots.set(origin, fetching);
+
+    try {
+      const disallowedPaths = await fetching;
+
+      await this.robots.set(origin, disallowedPaths);
+
+      return disallowedPaths;
+    } finally {
+      this.pendingRobots.delete(origin);
+    }
+  }
+
+  private async fetchDisallowedPaths(origin: string): Promise<string[]> {
+    const robots = await axios
+      .get<string>(`${origin}/robots.txt`, {
+        responseType: 'text',
+        timeout: 5000,
+        maxRedirects: 0,
+        maxContentLength: MAX_RESPONSE_SIZE,
+        headers: { 'User-Agent': USER_AGENT },
+      })
+      .then((r) => r.data)
+      .catch(() => '');
+
+    const disallowedPaths: string[] = [];
+
+    let isMatchingGroup = false;
+    let isReadingAgents = false;
+
+    for (const line of robots.split('\n')) {
+      const [key, ...rest] = line.replace(/#.*/, '').split(':');
+      const value = rest.join(':').trim();
+
+      switch (key.trim().toLowerCase()) {
+        case 'user-agent': {
+          isMatchingGroup = (isReadingAgents && isMatchingGroup) || value === '*';
+          isReadingAgents = true;
+          break;
+        }
+        case 'disallow': {
+          isReadingAgents = false;
+
+          if (isMatchingGroup && value) {
+            disallowedPaths.push(value);
+          }
+          break;
+        }
+        default: {
+          isReadingAgents = false;
+        }
+      }
+    }
+
+    return disallowedPaths;
+  }
+
+  // Redirects are followed by hand: an open redirect on an allowed domain must not lead the bot
+  // to any other host, internal addresses included
+  private async fetchText(url: URL): Promise<string> {
+    let currentUrl = url;
+    let response = await this.fetchPage(currentUrl);
+
+    for (let redirects = 0; response.status >= 300 && response.status < 400; redirects++) {
+      const location = response.headers['location'];
+      const nextUrl = location ? this.parseUrl(location, currentUrl) : null;
+
+      if (redirects === MAX_REDIRECTS || !nextUrl?.protocol.match(/^https?:$/)) {
+        throw new Error(`Invalid redirect to ${location}`);
+      }
+
+      if (!this.isAllowedDomain(nextUrl) || !(await this.isAllowedByRobots(nextUrl))) {
+        this.logger.log(`Skipping ${url.href}: redirects to disallowed ${nextUrl.href}`);
+        return '';
+      }
+
+      currentUrl = nextUrl;
+      response = await this.fetchPage(currentUrl);
+    }
+
+    const contentType = String(response.headers['content-type'] ?? '');
+
+    const text = contentType.includes('text/html')
+      ? extractHtmlText(response.data)
+      : contentType.startsWith('text/')
+        ? response.data.trim()
+        : '';
+
+    const maxLength = this.config.urlContextMaxLength ?? 10000;
+
+    return text.length > maxLength ? `${text.slice(0, maxLength)}…` : text;
+  }
+
+  private async fetchPage(url: URL): Promise<AxiosResponse<string>> {
+    return await axios.get<string>(url.href, {
+      responseType: 'text',
+      timeout: 10000,
+      maxRedirects: 0,
+      maxContentLength: MAX_RESPONSE_SIZE,
+      headers: { 'User-Agent': USER_AGENT },
+      validateStatus: (status) => status < 400,
+    });
+  }
+}
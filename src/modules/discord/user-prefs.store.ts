@@ -0,0 +1,23 @@
+import { Injectable } from '@nestjs/common';
+
+import { CompletionPreferences } from '../anthropic';
+
+export type UserPrefs = CompletionPreferences;
+
+export abstract class UserPrefsStore {
+  abstract get(userId: string): Promise<UserPrefs>;
+  abstract set(userId: string, prefs: UserPrefs): Promise<void>;
+}
+
+@Injectable()
+export class InMemoryUserPrefsStore extends UserPrefsStore {
+  private readonly prefs: Map<string, UserPrefs> = new Map();
+
+  async get(userId: string): Promise<UserPrefs> {
+    return this.prefs.get(userId) ?? {};
+  }
+
+  async set(userId: string, prefs: UserPrefs): Promise<void> {
+    this.prefs.set(userId, prefs);
+  }
+}
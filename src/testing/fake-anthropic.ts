@@ -0,0 +1,157 @@
+import { APIUserAbortError } from '@anthropic-ai/sdk';
+import { MessageStreamParams } from '@anthropic-ai/sdk/resources';
+import { EventEmitter } from 'events';
+import { from, isObservable, Observable } from 'rxjs';
+
+import {
+  AnthropicClient,
+  AnthropicClientFactory,
+  AnthropicClientOptions,
+  AnthropicService,
+  CountTokensParams,
+  TokenEstimate,
+} from '../modules/anthropic';
+import { CompletionMessage } from '../modules/anthropic/dto/common';
+import {
+  CreateCompletionOptionsDto,
+  CreateCompletionResultDto,
+} from '../modules/anthropic/dto/internal';
+
+export type FakeCompletion = CreateCompletionResultDto[] | Observable<CreateCompletionResultDto>;
+
+// Answers completions with canned responses and keeps the options of every request
+export class FakeAnthropicService {
+  readonly requests: CreateCompletionOptionsDto[] = [];
+
+  // The history of every request from the newest message to the oldest, read before responding
+  // as the real service does
+  readonly histories: CompletionMessage[][] = [];
+
+  // Each completion takes the next response, the last one is repeated for any later completion
+  constructor(private readonly completions: FakeCompletion[] = [[{ chunk: 'Ответ' }]]) {}
+
+  get asService(): AnthropicService {
+    return this as unknown as AnthropicService;
+  }
+
+  async createCompletion(
+    options: CreateCompletionOptionsDto,
+  ): Promise<Observable<CreateCompletionResultDto>> {
+    this.requests.push(options);
+
+    const history: CompletionMessage[] = [];
+
+    for (
+      let message = await options.getPreviousMessage?.();
+      message;
+      message = await options.getPreviousMessage?.()
+    ) {
+      history.push(message);
+    }
+
+    this.histories.push(history);
+
+    const completion =
+      this.completions.length > 1 ? this.completions.shift() : this.completions[0];
+
+    return isObservable(completion) ? completion : from(completion ?? []);
+  }
+
+  async estimateTokens(): Promise<TokenEstimate> {
+    return { inputTokens: 0, maxTokens: 0, messages: 0 };
+  }
+
+  validateAttachment(): boolean {
+    return true;
+  }
+}
+
+// Emits the events of the SDK message stream the service listens to, as the test scripts them
+export class FakeMessageStream extends EventEmitter {
+  aborted = false;
+
+  constructor(readonly params: MessageStreamParams, readonly signal?: AbortSignal) {
+    super();
+
+    signal?.addEventListener('abort', () => this.abort());
+  }
+
+  abort(): void {
+    if (!this.aborted) {
+      this.aborted = true;
+      this.emit('abort', new APIUserAbortError());
+    }
+  }
+
+  // The events of a response streamed in the given chunks, from the connection to the end
+  respond(
+    chunks: string[],
+    stopReason: string = 'end_turn',
+    usage = { input_tokens: 10, output_tokens: 5 },
+  ): void {
+    this.emit('connect');
+
+    for (const chunk of chunks) {
+      this.emit('streamEvent', {
+        type: 'content_block_delta',
+        index: 0,
+        delta: { type: 'text_delta', text: chunk },
+      });
+      this.emit('text', chunk, chunks.join(''));
+    }
+
+    this.emit('finalMessage', {
+      id: 'msg',
+      type: 'message',
+      role: 'assistant',
+      model: this.params.model,
+      content: [{ type: 'text', text: chunks.join('') }],
+      stop_reason: stopReason,
+      stop_sequence: null,
+      usage,
+    });
+    this.emit('end');
+  }
+}
+
+// Creates clients whose streams are driven by the test instead of the API
+export class FakeAnthropicClientFactory extends AnthropicClientFactory {
+  // Every stream opened by a client of the factory, in the order they were opened
+  readonly streams: FakeMessageStream[] = [];
+
+  readonly clients: { apiKey: string; options?: AnthropicClientOptions }[] = [];
+
+  countTokens: (params: CountTokensParams) => Promise<number> = async () => {
+    throw new Error('countTokens is not stubbed');
+  };
+
+  get lastStream(): FakeMessageStream {
+    const stream = this.streams.at(-1);
+
+    if (!stream) {
+      throw new Error('No stream was opened');
+    }
+
+    return stream;
+  }
+
+  create(apiKey: string, options?: AnthropicClientOptions): AnthropicClient {
+    this.clients.push({ apiKey, options });
+
+    const messages = {
+      stream: (params: MessageStreamParams, requestOptions?: { signal?: AbortSignal }) => {
+        const stream = new FakeMessageStream(params, requestOptions?.signal);
+
+        this.streams.push(stream);
+
+        return stream;
+      },
+    };
+
+    return {
+      apiKey,
+      messages: messages as unknown as AnthropicClient['messages'],
+      countTokens: (params) => this.countTokens(params),
+    };
+  }
+}
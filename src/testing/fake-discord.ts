@@ -0,0 +1,249 @@
+import {
+  Client,
+  Collection,
+  Message,
+  MessageCreateOptions,
+  MessageReaction,
+  TextBasedChannel,
+  User,
+} from 'discord.js';
+import { EventEmitter } from 'events';
+
+// Minimal stand-ins for the discord.js objects the services touch. Only what the services read is
+// implemented, everything else is missing, so a test fails loudly once a service needs more
+
+export interface FakeUser {
+  id: string;
+  bot: boolean;
+  displayName: string;
+  send: (content: string) => Promise<void>;
+  displayAvatarURL: () => string;
+}
+
+export interface FakeMessageOptions {
+  id?: string;
+  content?: string;
+  author?: FakeUser;
+  guildId?: string | null;
+  reference?: { messageId: string; channelId: string } | null;
+  attachments?: { id: string; name: string; url: string; size: number; contentType: string }[];
+  stickers?: { id: string; name: string; url: string; format: number }[];
+  createdAt?: Date;
+}
+
+export interface FakeClient {
+  client: Client;
+  user: FakeUser;
+  rest: EventEmitter;
+  channels: Map<string, FakeChannel>;
+}
+
+let lastId = 0;
+
+export const createId = (): string => `${100000000000000000n + BigInt(++lastId)}`;
+
+export const createUser = (
+  id: string = createId(),
+  displayName: string = `user-${id}`,
+): FakeUser => ({
+  id,
+  bot: false,
+  displayName,
+  send: async () => {},
+  displayAvatarURL: () => `https://cdn.example.com/avatars/${id}.png`,
+});
+
+export const createClient = (): FakeClient => {
+  const user = { ...createUser('bot', 'Bot'), bot: true };
+  const rest = new EventEmitter();
+  const channels: Map<string, FakeChannel> = new Map();
+
+  const client = {
+    user,
+    rest,
+    channels: {
+      fetch: async (id: string) => channels.get(id) ?? null,
+    },
+  } as unknown as Client;
+
+  return { client, user, rest, channels };
+};
+
+export class FakeChannel {
+  readonly messages: {
+    cache: Map<string, Message>;
+    fetch: (query: string | { limit?: number; before?: string }) => Promise<unknown>;
+  };
+
+  // Every message sent by the bot, replies included, in the order they were sent
+  readonly sent: Message[] = [];
+
+  // The options of every message sent or edited by the bot
+  readonly payloads: MessageCreateOptions[] = [];
+
+  typing = 0;
+
+  constructor(
+    private readonly fake: FakeClient,
+    readonly id: string = createId(),
+    readonly guildId: string | null = null,
+    readonly parentId: string | null = null,
+  ) {
+    const cache: Map<string, Message> = new Map();
+
+    this.messages = {
+      cache,
+      fetch: async (query) => {
+        if (typeof query === 'string') {
+          const message = cache.get(query);
+
+          if (!message) {
+            throw new Error(`Unknown message ${query}`);
+          }
+
+          return message;
+        }
+
+        const before = query.before ? cache.get(query.before)?.createdTimestamp : undefined;
+
+        return new Collection(
+          [...cache]
+            .filter(([, message]) => before === undefined || message.createdTimestamp < before)
+            .reverse()
+            .slice(0, query.limit),
+        );
+      },
+    };
+
+    fake.channels.set(id, this);
+  }
+
+  get asChannel(): TextBasedChannel {
+    return this as unknown as TextBasedChannel;
+  }
+
+  isTextBased(): boolean {
+    return true;
+  }
+
+  isThread(): boolean {
+    return this.parentId !== null;
+  }
+
+  async fetchStarterMessage(): Promise<Message | null> {
+    return null;
+  }
+
+  permissionsFor(): null {
+    return null;
+  }
+
+  async sendTyping(): Promise<void> {
+    this.typing++;
+  }
+
+  async send(options: string | MessageCreateOptions): Promise<Message> {
+    const payload = typeof options === 'string' ? { content: options } : options;
+
+    const message = createMessage(this, {
+      author: this.fake.user,
+      content: payload.content ?? '',
+      guildId: this.guildId,
+      reference: payload.reply
+        ? { messageId: `${payload.reply.messageReference}`, channelId: this.id }
+        : null,
+    });
+
+    Object.assign(message, { options: payload });
+    this.sent.push(message);
+    this.payloads.push(payload);
+
+    return message;
+  }
+
+  toString(): string {
+    return `<#${this.id}>`;
+  }
+}
+
+// Options of the last send or edit of a message sent by the bot
+export const getOptions = (message: Message): MessageCreateOptions =>
+  (message as unknown as { options: MessageCreateOptions }).options;
+
+export const createMessage = (channel: FakeChannel, options: FakeMessageOptions = {}): Message => {
+  const id = options.id ?? createId();
+  const author = options.author ?? createUser();
+  const content = options.content ?? '';
+  const createdAt = options.createdAt ?? new Date();
+  const guildId = options.guildId === undefined ? channel.guildId : options.guildId;
+
+  const reactions: Collection<string, unknown> = new Collection();
+
+  const message: Record<string, unknown> = {
+    id,
+    author,
+    content,
+    cleanContent: content,
+    channel,
+    channelId: channel.id,
+    guildId,
+    guild: null,
+    member: null,
+    webhookId: null,
+    partial: false,
+    deleted: false,
+    createdAt,
+    createdTimestamp: createdAt.getTime(),
+    reference: options.reference ?? null,
+    embeds: [],
+    attachments: new Collection(
+      (options.attachments ?? []).map((attachment) => [attachment.id, attachment]),
+    ),
+    stickers: new Collection((options.stickers ?? []).map((sticker) => [sticker.id, sticker])),
+    mentions: {
+      users: new Collection(),
+      members: null,
+      repliedUser: null,
+      has: () => false,
+    },
+    reactions: { cache: reactions },
+    inGuild: () => guildId !== null,
+    fetch: async () => message,
+    reply: async (replyOptions: string | MessageCreateOptions) =>
+      await channel.send({
+        ...(typeof replyOptions === 'string' ? { content: replyOptions } : replyOptions),
+        reply: { messageReference: id },
+      }),
+    edit: async (editOptions: MessageCreateOptions) => {
+      Object.assign(message, {
+        content: editOptions.content ?? '',
+        cleanContent: editOptions.content ?? '',
+        options: editOptions,
+      });
+      channel.payloads.push(editOptions);
+      return message;
+    },
+    delete: async () => {
+      Object.assign(message, { deleted: true });
+      channel.messages.cache.delete(id);
+      return message;
+    },
+    react: async (emoji: string) => {
+      const reaction = { emoji: { id: null, name: emoji }, count: 1, me: true };
+      const users = { remove: async () => reactions.delete(emoji) };
+
+      reactions.set(emoji, { ...reaction, users });
+      return { ...reaction, users };
+    },
+  };
+
+  channel.messages.cache.set(id, message as unknown as Message);
+
+  return message as unknown as Message;
+};
+
+// A reaction added to the message, as the gateway passes it along with the user who added it
+export const createReaction = (message: Message, emoji: string): MessageReaction =>
+  ({ emoji: { id: null, name: emoji }, message, count: 1 }) as unknown as MessageReaction;
+
+export const asUser = (user: FakeUser): User => user as unknown as User;
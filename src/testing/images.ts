@@ -0,0 +1,18 @@
+const PNG_SIGNATURE = [0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a];
+
+// A PNG header declaring the given dimensions, padded to the given size. Nothing decodes the
+// pixels, so the rest of the file is left empty
+export const createPng = (width: number, height: number, size: number = 33): Buffer => {
+  const header = Buffer.alloc(25);
+
+  header.writeUInt32BE(13, 0);
+  header.write('IHDR', 4, 'ascii');
+  header.writeUInt32BE(width, 8);
+  header.writeUInt32BE(height, 12);
+  header.writeUInt8(8, 16);
+  header.writeUInt8(6, 17);
+
+  const png = Buffer.concat([Buffer.from(PNG_SIGNATURE), header]);
+
+  return size > png.length ? Buffer.concat([png, Buffer.alloc(size - png.length)]) : png;
+};
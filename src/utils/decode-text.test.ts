@@ -0,0 +1,54 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { decodeText } from './decode-text';
+
+describe('decodeText', () => {
+  it('reads text without a BOM as UTF-8', () => {
+    assert.equal(decodeText(Buffer.from('Привет, world')), 'Привет, world');
+  });
+
+  it('strips the UTF-8 BOM', () => {
+    const buffer = Buffer.concat([Buffer.from([0xef, 0xbb, 0xbf]), Buffer.from('Привет')]);
+
+    assert.equal(decodeText(buffer), 'Привет');
+  });
+
+  it('reads UTF-16 with either byte order', () => {
+    const littleEndian = Buffer.concat([
+      Buffer.from([0xff, 0xfe]),
+      Buffer.from('Привет', 'utf16le'),
+    ]);
+    const bigEndian = Buffer.concat([
+      Buffer.from([0xfe, 0xff]),
+      Buffer.from('Привет', 'utf16le').swap16(),
+    ]);
+
+    assert.equal(decodeText(littleEndian), 'Привет');
+    assert.equal(decodeText(bigEndian), 'Привет');
+  });
+
+  it('ignores a trailing odd byte of UTF-16 text', () => {
+    const buffer = Buffer.concat([
+      Buffer.from([0xff, 0xfe]),
+      Buffer.from('ok', 'utf16le'),
+      Buffer.from([0x41]),
+    ]);
+
+    assert.equal(decodeText(buffer), 'ok');
+  });
+
+  it('uses the fallback encoding only for invalid UTF-8', () => {
+    // "Привет" in windows-1251
+    const legacy = Buffer.from([0xcf, 0xf0, 0xe8, 0xe2, 0xe5, 0xf2]);
+
+    assert.equal(decodeText(legacy, 'windows-1251'), 'Привет');
+    assert.equal(decodeText(Buffer.from('Привет'), 'windows-1251'), 'Привет');
+  });
+
+  it('falls back to UTF-8 for an unknown encoding', () => {
+    const buffer = Buffer.from([0x41, 0xff]);
+
+    assert.equal(decodeText(buffer, 'unknown'), buffer.toString('utf8'));
+  });
+});
@@ -0,0 +1,48 @@
+import { isUtf8 } from 'buffer';
+
+// Legacy encodings a guild may fall back to, all of them are WHATWG labels known to TextDecoder
+export const TEXT_ENCODINGS = [
+  'ibm866',
+  'iso-8859-2',
+  'iso-8859-5',
+  'koi8-r',
+  'koi8-u',
+  'windows-1250',
+  'windows-1251',
+  'windows-1252',
+  'shift_jis',
+  'euc-jp',
+  'euc-kr',
+  'gbk',
+  'gb18030',
+  'big5',
+];
+
+// Files without a BOM are read as UTF-8, the fallback encoding is only used for those that are
+// not valid UTF-8
+export const decodeText = (buffer: Buffer, fallbackEncoding?: string): string => {
+  if (buffer[0] === 0xef && buffer[1] === 0xbb && buffer[2] === 0xbf) {
+    return buffer.subarray(3).toString('utf8');
+  }
+
+  if (buffer[0] === 0xff && buffer[1] === 0xfe) {
+    return buffer.subarray(2, buffer.length - (buffer.length % 2)).toString('utf16le');
+  }
+
+  if (buffer[0] === 0xfe && buffer[1] === 0xff) {
+    return Buffer.from(buffer.subarray(2, buffer.length - (buffer.length % 2)))
+      .swap16()
+      .toString('utf16le');
+  }
+
+  // Node built without full ICU has no legacy encodings, such files stay lossy UTF-8 there
+  if (fallbackEncoding && !isUtf8(buffer)) {
+    try {
+      return new TextDecoder(fallbackEncoding).decode(buffer);
+    } catch (error) {
+      return buffer.toString('utf8');
+    }
+  }
+
+  return buffer.toString('utf8');
+};
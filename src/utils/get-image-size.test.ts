@@ -0,0 +1,34 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { createPng } from '../testing/images';
+
+import { getImageSize } from './get-image-size';
+
+describe('getImageSize', () => {
+  it('reads the dimensions of a PNG from its header', () => {
+    assert.deepEqual(getImageSize(createPng(100000, 100000)), { width: 100000, height: 100000 });
+  });
+
+  it('reads the dimensions of a GIF from its header', () => {
+    const gif = Buffer.from([0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x40, 0x01, 0xf0, 0x00]);
+
+    assert.deepEqual(getImageSize(gif), { width: 320, height: 240 });
+  });
+
+  it('reads the dimensions of a JPEG from its frame header, past the other segments', () => {
+    const jpeg = Buffer.from([
+      // SOI, then an APP0 segment of 4 bytes
+      0xff, 0xd8, 0xff, 0xe0, 0x00, 0x04, 0x00, 0x00,
+      // SOF0 with a height of 600 and a width of 800
+      0xff, 0xc0, 0x00, 0x11, 0x08, 0x02, 0x58, 0x03, 0x20, 0x03,
+    ]);
+
+    assert.deepEqual(getImageSize(jpeg), { width: 800, height: 600 });
+  });
+
+  it('returns null for a file that is not an image or is cut short', () => {
+    assert.equal(getImageSize(Buffer.from('not an image')), null);
+    assert.equal(getImageSize(createPng(100, 100).subarray(0, 20)), null);
+  });
+});
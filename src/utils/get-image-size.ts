@@ -0,0 +1,119 @@
+export interface ImageSize {
+  width: number;
+  height: number;
+}
+
+const PNG_SIGNATURE = Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]);
+
+// SOF markers that carry the frame size, DHT (0xc4), JPG (0xc8) and DAC (0xcc) share the range
+const isJpegFrameMarker = (marker: number): boolean =>
+  marker >= 0xc0 && marker <= 0xcf && marker !== 0xc4 && marker !== 0xc8 && marker !== 0xcc;
+
+const getJpegSize = (buffer: Buffer): ImageSize | null => {
+  let offset = 2;
+
+  while (offset + 9 <= buffer.length) {
+    if (buffer[offset] !== 0xff) {
+      return null;
+    }
+
+    const marker = buffer[offset + 1];
+
+    if (marker === 0xff) {
+      offset++;
+      continue;
+    }
+
+    if (isJpegFrameMarker(marker)) {
+      return {
+        height: buffer.readUInt16BE(offset + 5),
+        width: buffer.readUInt16BE(offset + 7),
+      };
+    }
+
+    if (marker === 0x01 || (marker >= 0xd0 && marker <= 0xd8)) {
+      offset += 2;
+      continue;
+    }
+
+    offset += 2 + buffer.readUInt16BE(offset + 2);
+  }
+
+  return null;
+};
+
+const getWebpSize = (buffer: Buffer): ImageSize | null => {
+  const chunk = buffer.toString('ascii', 12, 16);
+
+  if (chunk === 'VP8 ' && buffer.length >= 30) {
+    return {
+      width: buffer.readUInt16LE(26) & 0x3fff,
+      height: buffer.readUInt16LE(28) & 0x3fff,
+    };
+  }
+
+  if (chunk === 'VP8L' && buffer.length >= 25) {
+    const bits = buffer.readUInt32LE(21);
+
+    return {
+      width: (bits & 0x3fff) + 1,
+      height: ((bits >>> 14) & 0x3fff) + 1,
+    };
+  }
+
+  if (chunk === 'VP8X' && buffer.length >= 30) {
+    return {
+      width: buffer.readUIntLE(24, 3) + 1,
+      height: buffer.readUIntLE(27, 3) + 1,
+    };
+  }
+
+  return null;
+};
+
+export type ImageMediaType = 'image/jpeg' | 'image/png' | 'image/gif' | 'image/webp';
+
+// Sniffs the format from the file signature, the content type declared by the uploader may be wrong
+export const getImageType = (buffer: Buffer): ImageMediaType | null => {
+  if (buffer.length >= 8 && buffer.subarray(0, 8).equals(PNG_SIGNATURE)) {
+    return 'image/png';
+  }
+
+  if (buffer.length >= 4 && buffer.toString('ascii', 0, 4) === 'GIF8') {
+    return 'image/gif';
+  }
+
+  if (
+    buffer.length >= 12 &&
+    buffer.toString('ascii', 0, 4) === 'RIFF' &&
+    buffer.toString('ascii', 8, 12) === 'WEBP'
+  ) {
+    return 'image/webp';
+  }
+
+  if (buffer.length >= 2 && buffer[0] === 0xff && buffer[1] === 0xd8) {
+    return 'image/jpeg';
+  }
+
+  return null;
+};
+
+// Reads the dimensions from the image header only, without decoding any pixel data
+export const getImageSize = (buffer: Buffer): ImageSize | null => {
+  switch (getImageType(buffer)) {
+    case 'image/png':
+      return buffer.length >= 24
+        ? { width: buffer.readUInt32BE(16), height: buffer.readUInt32BE(20) }
+        : null;
+    case 'image/gif':
+      return buffer.length >= 10
+        ? { width: buffer.readUInt16LE(6), height: buffer.readUInt16LE(8) }
+        : null;
+    case 'image/webp':
+      return buffer.length >= 16 ? getWebpSize(buffer) : null;
+    case 'image/jpeg':
+      return buffer.length >= 4 ? getJpegSize(buffer) : null;
+    default:
+      return null;
+  }
+};
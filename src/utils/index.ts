@@ -1 +1,13 @@
-export {};
+export * from './map-concurrently';
+export * from './validate-config';
+export * from './split-text';
+export * from './sanitize-text';
+export * from './sleep';
+export * from './decode-text';
+export * from './keyed-mutex';
+export * from './extract-html-text';
+export * from './truncate-text';
+export * from './get-image-size';
+export * from './prefetch';
+export * from './render-template';
+export * from './is-reg-exp';
@@ -0,0 +1,29 @@
+import { buildMessage, ValidateBy, ValidationOptions } from 'class-validator';
+
+const isRegExp = (value: unknown): boolean => {
+  if (typeof value !== 'string') {
+    return false;
+  }
+
+  try {
+    new RegExp(value);
+    return true;
+  } catch (error) {
+    return false;
+  }
+};
+
+export const IsRegExp = (validationOptions?: ValidationOptions): PropertyDecorator =>
+  ValidateBy(
+    {
+      name: 'isRegExp',
+      validator: {
+        validate: isRegExp,
+        defaultMessage: buildMessage(
+          (eachPrefix) => `${eachPrefix}$property must be a valid regular expression`,
+          validationOptions,
+        ),
+      },
+    },
+    validationOptions,
+  );
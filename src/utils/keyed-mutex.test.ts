@@ -0,0 +1,68 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { KeyedMutex } from './keyed-mutex';
+import { sleep } from './sleep';
+
+describe('KeyedMutex', () => {
+  it('runs callbacks of the same key one after another', async () => {
+    const mutex = new KeyedMutex();
+    const events: string[] = [];
+
+    const run = (name: string, delay: number) =>
+      mutex.run('channel', async () => {
+        events.push(`${name} start`);
+        await sleep(delay);
+        events.push(`${name} end`);
+        return name;
+      });
+
+    assert.deepEqual(await Promise.all([run('first', 20), run('second', 0)]), ['first', 'second']);
+    assert.deepEqual(events, ['first start', 'first end', 'second start', 'second end']);
+  });
+
+  it('runs callbacks of different keys concurrently', async () => {
+    const mutex = new KeyedMutex();
+    const events: string[] = [];
+
+    const run = (key: string, delay: number) =>
+      mutex.run(key, async () => {
+        events.push(`${key} start`);
+        await sleep(delay);
+        events.push(`${key} end`);
+      });
+
+    await Promise.all([run('a', 20), run('b', 0)]);
+
+    assert.deepEqual(events, ['a start', 'b start', 'b end', 'a end']);
+  });
+
+  it('counts the running and queued callbacks of a key', async () => {
+    const mutex = new KeyedMutex();
+
+    const first = mutex.run('channel', () => sleep(10));
+    const second = mutex.run('channel', () => sleep(10));
+
+    assert.equal(mutex.getQueueSize('channel'), 2);
+    assert.equal(mutex.getQueueSize('other'), 0);
+
+    await first;
+    assert.equal(mutex.getQueueSize('channel'), 1);
+
+    await second;
+    assert.equal(mutex.getQueueSize('channel'), 0);
+  });
+
+  it('releases the key when a callback throws', async () => {
+    const mutex = new KeyedMutex();
+
+    const failing = mutex.run('channel', async () => {
+      throw new Error('failed');
+    });
+    const next = mutex.run('channel', async () => 'next');
+
+    await assert.rejects(failing, /failed/);
+    assert.equal(await next, 'next');
+    assert.equal(mutex.getQueueSize('channel'), 0);
+  });
+});
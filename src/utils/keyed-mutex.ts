@@ -0,0 +1,31 @@
+export class KeyedMutex {
+  private readonly queues: Map<string, Promise<void>> = new Map();
+
+  private readonly sizes: Map<string, number> = new Map();
+
+  getQueueSize(key: string): number {
+    return this.sizes.get(key) ?? 0;
+  }
+
+  async run<T>(key: string, callback: () => Promise<T>): Promise<T> {
+    const current = (this.queues.get(key) ?? Promise.resolve()).then(callback);
+    const settled = current.then(
+      () => undefined,
+      () => undefined,
+    );
+
+    this.queues.set(key, settled);
+    this.sizes.set(key, this.getQueueSize(key) + 1);
+
+    try {
+      return await current;
+    } finally {
+      this.sizes.set(key, this.getQueueSize(key) - 1);
+
+      if (this.queues.get(key) === settled) {
+        this.queues.delete(key);
+        this.sizes.delete(key);
+      }
+    }
+  }
+}
@@ -0,0 +1,52 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { mapConcurrently } from './map-concurrently';
+import { sleep } from './sleep';
+
+describe('mapConcurrently', () => {
+  it('keeps the order of the items whatever order they finish in', async () => {
+    const delays = [30, 0, 20, 10];
+
+    const result = await mapConcurrently(delays, 4, async (delay, index) => {
+      await sleep(delay);
+      return index;
+    });
+
+    assert.deepEqual(result, [0, 1, 2, 3]);
+  });
+
+  it('runs at most the given number of callbacks at once', async () => {
+    let running = 0;
+    let maxRunning = 0;
+
+    await mapConcurrently([...Array(10).keys()], 3, async () => {
+      running++;
+      maxRunning = Math.max(maxRunning, running);
+      await sleep(5);
+      running--;
+    });
+
+    assert.equal(maxRunning, 3);
+  });
+
+  it('runs the callbacks concurrently', async () => {
+    const startedAt = Date.now();
+
+    await mapConcurrently([...Array(4).keys()], 4, () => sleep(50));
+
+    assert.ok(Date.now() - startedAt < 150);
+  });
+
+  it('runs one callback at a time for a concurrency below one', async () => {
+    const events: string[] = [];
+
+    await mapConcurrently(['a', 'b'], 0, async (item) => {
+      events.push(`${item} start`);
+      await sleep(5);
+      events.push(`${item} end`);
+    });
+
+    assert.deepEqual(events, ['a start', 'a end', 'b start', 'b end']);
+  });
+});
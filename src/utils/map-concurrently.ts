@@ -0,0 +1,22 @@
+export const mapConcurrently = async <T, R>(
+  items: T[],
+  concurrency: number,
+  callback: (item: T, index: number) => Promise<R>,
+): Promise<R[]> => {
+  const result: R[] = new Array(items.length);
+
+  let nextIndex = 0;
+
+  const worker = async () => {
+    while (nextIndex < items.length) {
+      const index = nextIndex++;
+      result[index] = await callback(items[index], index);
+    }
+  };
+
+  await Promise.all(
+    Array.from({ length: Math.max(1, Math.min(concurrency, items.length)) }, () => worker()),
+  );
+
+  return result;
+};
@@ -0,0 +1,52 @@
+// Runs a sequential producer up to `size` calls ahead of its consumer. Calls never overlap and
+// results come back in order; the producer is not called again once it returned null or threw.
+export const prefetch = <T>(
+  next: () => Promise<T | null>,
+  size: number,
+): (() => Promise<T | null>) => {
+  const queue: Promise<T | null>[] = [];
+
+  let tail: Promise<unknown> = Promise.resolve();
+  let isDone = false;
+
+  const enqueue = () => {
+    const item = tail.then(async () => {
+      if (isDone) {
+        return null;
+      }
+
+      try {
+        const value = await next();
+        isDone = value === null;
+        return value;
+      } catch (error) {
+        isDone = true;
+        throw error;
+      }
+    });
+
+    // Prefetched items may never be consumed, so their rejections must not go unhandled
+    tail = item.catch(() => null);
+    queue.push(item);
+  };
+
+  const fill = () => {
+    while (queue.length < size) {
+      enqueue();
+    }
+  };
+
+  fill();
+
+  return async () => {
+    if (!queue.length) {
+      enqueue();
+    }
+
+    const item = queue.shift() as Promise<T | null>;
+
+    fill();
+
+    return await item;
+  };
+};
@@ -0,0 +1,66 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { getTemplateError, renderTemplate } from './render-template';
+
+describe('renderTemplate', () => {
+  it('renders text without tags as is', () => {
+    assert.equal(renderTemplate('Plain { text }', {}), 'Plain { text }');
+  });
+
+  it('renders values and nested paths', () => {
+    assert.equal(
+      renderTemplate('{{ name }} from {{guild.name}}', { name: 'Alice', guild: { name: 'Club' } }),
+      'Alice from Club',
+    );
+  });
+
+  it('renders missing values as empty and arrays as lists', () => {
+    assert.equal(renderTemplate('[{{missing}}] {{tags}}', { tags: ['a', 'b'] }), '[] a, b');
+  });
+
+  it('renders conditional blocks', () => {
+    const template = '{{#if admin}}admin{{else}}user{{/if}}{{#unless muted}}!{{/unless}}';
+
+    assert.equal(renderTemplate(template, { admin: true, muted: false }), 'admin!');
+    assert.equal(renderTemplate(template, { admin: false, muted: true }), 'user');
+  });
+
+  it('treats empty arrays as false', () => {
+    assert.equal(renderTemplate('{{#if items}}yes{{else}}no{{/if}}', { items: [] }), 'no');
+  });
+
+  it('renders each item with its index and the outer scope', () => {
+    assert.equal(
+      renderTemplate('{{#each users}}{{@index}}:{{name}}@{{guild}} {{/each}}', {
+        guild: 'Club',
+        users: [{ name: 'Alice' }, { name: 'Bob' }],
+      }),
+      '0:Alice@Club 1:Bob@Club ',
+    );
+    assert.equal(
+      renderTemplate('{{#each tags}}<{{this}}>{{/each}}', { tags: ['a', 'b'] }),
+      '<a><b>',
+    );
+  });
+
+  it('rejects malformed templates', () => {
+    assert.throws(() => renderTemplate('{{#if a}}', {}), /Unclosed \{\{#if\}\}/);
+    assert.throws(() => renderTemplate('{{#if a}}{{/each}}', {}), /Unexpected \{\{\/each\}\}/);
+    assert.throws(
+      () => renderTemplate('{{#each a}}{{else}}{{/each}}', {}),
+      /Unexpected \{\{else\}\}/,
+    );
+    assert.throws(() => renderTemplate('{{a b}}', {}), /Invalid template tag/);
+  });
+});
+
+describe('getTemplateError', () => {
+  it('returns null for a valid template', () => {
+    assert.equal(getTemplateError('{{#each a}}{{this}}{{/each}}'), null);
+  });
+
+  it('returns the parse error of an invalid template', () => {
+    assert.equal(getTemplateError('{{#unless a}}'), 'Unclosed {{#unless}} in template');
+  });
+});
@@ -0,0 +1,192 @@
+import { buildMessage, ValidateBy, ValidationOptions } from 'class-validator';
+
+import { AppError } from '../common/errors';
+
+type TemplateNode =
+  | { type: 'text'; text: string }
+  | { type: 'value'; path: string }
+  | {
+      type: 'if';
+      path: string;
+      isNegated: boolean;
+      body: TemplateNode[];
+      otherwise: TemplateNode[];
+    }
+  | { type: 'each'; path: string; body: TemplateNode[] };
+
+type BlockNode = Extract<TemplateNode, { type: 'if' | 'each' }>;
+
+const TAG_PATTERN = /\{\{\s*(.*?)\s*\}\}/g;
+
+const PATH_PATTERN = /^(@index|this|[a-zA-Z_]\w*)(\.[a-zA-Z_]\w*)*$/;
+
+const BLOCK_PATTERN = /^#(if|unless|each)\s+(\S+)$/;
+
+const CLOSE_PATTERN = /^\/(if|unless|each)$/;
+
+const parseTemplate = (template: string): TemplateNode[] => {
+  const root: TemplateNode[] = [];
+  const blocks: { keyword: string; node: BlockNode; nodes: TemplateNode[] }[] = [];
+
+  let nodes = root;
+  let offset = 0;
+
+  for (const match of template.matchAll(TAG_PATTERN)) {
+    const index = match.index as number;
+    const tag = match[1];
+
+    if (index > offset) {
+      nodes.push({ type: 'text', text: template.slice(offset, index) });
+    }
+
+    offset = index + match[0].length;
+
+    const block = tag.match(BLOCK_PATTERN);
+
+    if (block) {
+      const [, keyword, path] = block;
+
+      if (!PATH_PATTERN.test(path)) {
+        throw new AppError(`Invalid template path "${path}" in {{${tag}}}`);
+      }
+
+      const node: BlockNode =
+        keyword === 'each'
+          ? { type: 'each', path, body: [] }
+          : { type: 'if', path, isNegated: keyword === 'unless', body: [], otherwise: [] };
+
+      nodes.push(node);
+      nodes = node.body;
+      blocks.push({ keyword, node, nodes });
+      continue;
+    }
+
+    if (tag === 'else') {
+      const current = blocks.at(-1);
+
+      if (current?.node.type !== 'if' || current.nodes === current.node.otherwise) {
+        throw new AppError('Unexpected {{else}} in template');
+      }
+
+      nodes = current.nodes = current.node.otherwise;
+      continue;
+    }
+
+    const close = tag.match(CLOSE_PATTERN);
+
+    if (close) {
+      if (blocks.pop()?.keyword !== close[1]) {
+        throw new AppError(`Unexpected {{${tag}}} in template`);
+      }
+
+      nodes = blocks.at(-1)?.nodes ?? root;
+      continue;
+    }
+
+    if (!PATH_PATTERN.test(tag)) {
+      throw new AppError(`Invalid template tag {{${tag}}}`);
+    }
+
+    nodes.push({ type: 'value', path: tag });
+  }
+
+  if (blocks.length) {
+    throw new AppError(`Unclosed {{#${blocks[0].keyword}}} in template`);
+  }
+
+  if (offset < template.length) {
+    root.push({ type: 'text', text: template.slice(offset) });
+  }
+
+  return root;
+};
+
+// Scopes go from the innermost {{#each}} item to the template data, the first defined value wins
+const lookup = (scopes: unknown[], path: string): unknown => {
+  for (const scope of scopes) {
+    const value = path
+      .split('.')
+      .reduce<unknown>(
+        (object, key) =>
+          object !== null && typeof object === 'object'
+            ? (object as Record<string, unknown>)[key]
+            : undefined,
+        scope,
+      );
+
+    if (value !== undefined) {
+      return value;
+    }
+  }
+
+  return undefined;
+};
+
+const isTruthy = (value: unknown): boolean => (Array.isArray(value) ? !!value.length : !!value);
+
+const stringify = (value: unknown): string => {
+  if (value === null || value === undefined) {
+    return '';
+  }
+
+  return Array.isArray(value) ? value.map(stringify).join(', ') : String(value);
+};
+
+const renderNodes = (nodes: TemplateNode[], scopes: unknown[]): string =>
+  nodes
+    .map((node) => {
+      switch (node.type) {
+        case 'text':
+          return node.text;
+        case 'value':
+          return stringify(lookup(scopes, node.path));
+        case 'if':
+          return isTruthy(lookup(scopes, node.path)) !== node.isNegated
+            ? renderNodes(node.body, scopes)
+            : renderNodes(node.otherwise, scopes);
+        case 'each': {
+          const items = lookup(scopes, node.path);
+
+          return Array.isArray(items)
+            ? items
+                .map((item, index) =>
+                  renderNodes(node.body, [{ this: item, '@index': index }, item, ...scopes]),
+                )
+                .join('')
+            : '';
+        }
+      }
+    })
+    .join('');
+
+// A small Handlebars-like syntax: {{path.to.value}}, {{#if path}}…{{else}}…{{/if}},
+// {{#unless path}}…{{/unless}} and {{#each path}}…{{this}} {{@index}}…{{/each}}.
+// Text without tags renders as is, so plain prompts need no escaping
+export const renderTemplate = (template: string, data: object): string =>
+  renderNodes(parseTemplate(template), [data]);
+
+export const getTemplateError = (template: string): string | null => {
+  try {
+    parseTemplate(template);
+    return null;
+  } catch (error) {
+    return error instanceof Error ? error.message : String(error);
+  }
+};
+
+export const IsTemplate = (validationOptions?: ValidationOptions): PropertyDecorator =>
+  ValidateBy(
+    {
+      name: 'isTemplate',
+      validator: {
+        validate: (value) => typeof value === 'string' && getTemplateError(value) === null,
+        defaultMessage: buildMessage(
+          (eachPrefix, args) =>
+            `${eachPrefix}$property must be a valid template: ` +
+            getTemplateError(`${args?.value}`),
+          validationOptions,
+        ),
+      },
+    },
+    validationOptions,
+  );
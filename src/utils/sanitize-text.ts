@@ -0,0 +1,15 @@
+const ANSI_ESCAPE_PATTERN = /\x1b\[[0-?]*[ -/]*[@-~]|\x1b[@-_]/g;
+
+const CONTROL_PATTERN = /[^\P{Cc}\t\n\r]/gu;
+
+const FORMAT_PATTERN =
+  /(?<!\p{Extended_Pictographic}[\u{FE0F}\u{1F3FB}-\u{1F3FF}]?)\u200d|\u200d(?!\p{Extended_Pictographic})|[^\P{Cf}\u200d\u{E0020}-\u{E007F}]/gu;
+
+export const sanitizeText = (
+  text: string,
+  { format = true }: { format?: boolean } = {},
+): string => {
+  const result = text.replace(ANSI_ESCAPE_PATTERN, '').replace(CONTROL_PATTERN, '');
+
+  return format ? result.replace(FORMAT_PATTERN, '') : result;
+};
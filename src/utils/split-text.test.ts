@@ -0,0 +1,86 @@
+import { strict as assert } from 'assert';
+import { describe, it } from 'node:test';
+
+import { splitText } from './split-text';
+
+describe('splitText', () => {
+  it('keeps text that fits the limit in one chunk', () => {
+    assert.deepEqual(splitText('Hello, world!', 20), ['Hello, world!']);
+  });
+
+  it('keeps every chunk within the limit', () => {
+    const text = Array.from({ length: 50 }, (_, index) => `Sentence number ${index}.`).join(' ');
+
+    const chunks = splitText(text, 100);
+
+    assert.ok(chunks.length > 1);
+    assert.ok(chunks.every((chunk) => chunk.length <= 100));
+    assert.equal(chunks.join(' '), text);
+  });
+
+  it('prefers paragraph breaks over line and word breaks', () => {
+    assert.deepEqual(splitText('First paragraph\n\nSecond one\nwith two lines', 30), [
+      'First paragraph',
+      'Second one\nwith two lines',
+    ]);
+  });
+
+  it('reopens a code block cut in the middle', () => {
+    const code = Array.from({ length: 10 }, (_, index) => `const value${index} = ${index};`);
+
+    const chunks = splitText(`\`\`\`ts\n${code.join('\n')}\n\`\`\``, 120);
+
+    assert.ok(chunks.length > 1);
+    assert.ok(chunks.every((chunk) => chunk.length <= 120));
+    assert.ok(chunks.slice(0, -1).every((chunk) => chunk.endsWith('\n```')));
+    assert.ok(chunks.slice(1).every((chunk) => chunk.startsWith('```ts\n')));
+  });
+
+  it('does not reopen a code block with a language longer than a quarter of the limit', () => {
+    const language = 'x'.repeat(40);
+    const code = Array.from({ length: 10 }, (_, index) => `line ${index}`).join('\n');
+
+    const chunks = splitText(`\`\`\`${language}\n${code}\n\`\`\``, 100);
+
+    assert.ok(chunks.every((chunk) => chunk.length <= 100));
+    assert.ok(chunks.slice(1).every((chunk) => chunk.startsWith('```\n')));
+  });
+
+  it('does not reopen code blocks for limits too small to hold the fences', () => {
+    const text = '```\nabcdef ghijkl mnopqr\n```';
+
+    const chunks = splitText(text, 10);
+
+    assert.ok(chunks.every((chunk) => chunk.length <= 10));
+    assert.ok(chunks.slice(1).every((chunk) => !chunk.startsWith('```\n')));
+  });
+
+  it('does not cut a surrogate pair', () => {
+    const text = '😀'.repeat(20);
+
+    const chunks = splitText(text, 9);
+
+    assert.equal(chunks.join(''), text);
+    assert.ok(chunks.every((chunk) => !/[\ud800-\udbff]$/.test(chunk)));
+  });
+
+  it('repeats the header of a table continued in the next chunk', () => {
+    const header = '| a | b |\n|---|---|';
+    const rows = Array.from({ length: 10 }, (_, index) => `| ${index} | ${index} |`);
+
+    const chunks = splitText(`${header}\n${rows.join('\n')}`, 80);
+
+    assert.ok(chunks.length > 1);
+    assert.ok(chunks.every((chunk) => chunk.startsWith(header)));
+  });
+
+  it('continues the numbering of a list split between chunks', () => {
+    const items = Array.from({ length: 6 }, (_, index) => `${index + 1}. item`);
+
+    const chunks = splitText(items.join('\n'), 40);
+
+    assert.ok(chunks.length > 1);
+    assert.ok(chunks.slice(1).every((chunk) => !chunk.startsWith('1. ')));
+    assert.equal(chunks.join('\n'), items.join('\n'));
+  });
+});
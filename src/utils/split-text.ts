@@ -0,0 +1,198 @@
+const FENCE = '```';
+
+const MIN_FENCED_LIMIT = 16;
+
+const BREAK_PATTERNS: RegExp[] = [/\n[^\S\n]*\n/g, /\n/g, /[.!?…][)"'»]?[^\S\n]+/g, /[^\S\n]+/g];
+
+const TABLE_ROW_PATTERN = /^\s*\|/;
+
+const TABLE_SEPARATOR_PATTERN = /^\s*\|?(\s*:?-+:?\s*\|)+\s*(:?-+:?\s*)?$/;
+
+const INDENTED_LINE_PATTERN = /[^\S\n]+\S/y;
+
+const LIST_ITEM_PATTERN = /^([^\S\n]*)(\d{1,9})[.)][^\S\n]/;
+
+interface Table {
+  start: number;
+  end: number;
+  // The header and separator rows, repeated when the table continues in the next chunk
+  header: string | null;
+}
+
+const findTables = (text: string): Table[] => {
+  const tables: Table[] = [];
+
+  let rows: string[] = [];
+  let start = 0;
+  let offset = 0;
+
+  const addTable = () => {
+    if (rows.length > 1) {
+      tables.push({
+        start,
+        end: start + rows.join('\n').length,
+        header: TABLE_SEPARATOR_PATTERN.test(rows[1]) ? `${rows[0]}\n${rows[1]}` : null,
+      });
+    }
+
+    rows = [];
+  };
+
+  for (const line of text.split('\n')) {
+    if (TABLE_ROW_PATTERN.test(line)) {
+      if (!rows.length) {
+        start = offset;
+      }
+
+      rows.push(line);
+    } else {
+      addTable();
+    }
+
+    offset += line.length + 1;
+  }
+
+  addTable();
+
+  return tables;
+};
+
+const findTable = (tables: Table[], position: number): Table | null =>
+  tables.find(({ start, end }) => start < position && position < end) ?? null;
+
+const isInsideStructure = (text: string, tables: Table[], end: number, next: number): boolean => {
+  INDENTED_LINE_PATTERN.lastIndex = next;
+
+  return !!findTable(tables, end) || INDENTED_LINE_PATTERN.test(text);
+};
+
+const findBreak = (
+  text: string,
+  limit: number,
+  tables: Table[],
+): [end: number, next: number] => {
+  const head = text.slice(0, limit + 1);
+
+  // Tables and indented lines, such as the rest of a list item, are only split from what they
+  // belong to when no other break of the same kind is good enough
+  for (const pattern of BREAK_PATTERNS) {
+    for (const isStructureAllowed of [false, true]) {
+      let best: [number, number] | null = null;
+
+      for (const match of head.matchAll(pattern)) {
+        const end = (match.index as number) + match[0].trimEnd().length;
+
+        if (end > limit) {
+          break;
+        }
+
+        const next = (match.index as number) + match[0].length;
+
+        if (end > 0 && (isStructureAllowed || !isInsideStructure(text, tables, end, next))) {
+          best = [end, next];
+        }
+      }
+
+      if (best && best[0] >= limit / 2) {
+        return best;
+      }
+    }
+  }
+
+  const code = text.charCodeAt(limit - 1);
+  const end = code >= 0xd800 && code <= 0xdbff && limit > 1 ? limit - 1 : limit;
+
+  return [end, end];
+};
+
+const getOpenFence = (text: string): string | null => {
+  let language: string | null = null;
+
+  for (const line of text.split('\n')) {
+    const match = line.match(/^\s*```(\S*)/);
+
+    if (match) {
+      language = language === null ? match[1] : null;
+    }
+  }
+
+  return language;
+};
+
+// CommonMark numbers a list from its first item, so a list that continues in the next chunk has
+// to start there from the number following the items already sent
+const getNextListNumber = (chunk: string, indent: string): number | null => {
+  const lines = chunk.trimEnd().split('\n');
+
+  let first: number | null = null;
+  let count = 0;
+
+  for (const line of lines.reverse()) {
+    const item = line.match(LIST_ITEM_PATTERN);
+
+    if (item && item[1] === indent) {
+      first = Number(item[2]);
+      count++;
+    } else if (line.trim() && line.length - line.trimStart().length <= indent.length) {
+      break;
+    }
+  }
+
+  return first === null ? null : first + count;
+};
+
+export const splitText = (text: string, limit: number): string[] => {
+  const chunks: string[] = [];
+
+  let rest = text;
+  let openFence: string | null = null;
+
+  while (rest) {
+    const language = openFence !== null && openFence.length <= limit / 4 ? openFence : '';
+    const prefix = openFence === null ? '' : `${FENCE}${language}\n`;
+
+    if (prefix.length + rest.length <= limit) {
+      chunks.push(`${prefix}${rest}`);
+      break;
+    }
+
+    const tables = openFence === null ? findTables(rest) : [];
+
+    const [end, next] = findBreak(
+      rest,
+      Math.max(1, limit - prefix.length - FENCE.length - 1),
+      tables,
+    );
+
+    let chunk = `${prefix}${rest.slice(0, end)}`;
+
+    openFence = limit > MIN_FENCED_LIMIT ? getOpenFence(chunk) : null;
+
+    if (openFence !== null) {
+      chunk = `${chunk}\n${FENCE}`;
+    }
+
+    chunks.push(chunk);
+
+    const table = findTable(tables, end);
+
+    rest = rest.slice(next);
+
+    if (
+      table?.header &&
+      table.header.length <= limit / 4 &&
+      next > table.start + table.header.length
+    ) {
+      rest = `${table.header}\n${rest}`;
+    }
+
+    const item = openFence === null ? rest.match(LIST_ITEM_PATTERN) : null;
+    const number = item ? getNextListNumber(chunk, item[1]) : null;
+
+    if (item && number !== null && number !== Number(item[2])) {
+      rest = `${item[1]}${number}${rest.slice(item[1].length + item[2].length)}`;
+    }
+  }
+
+  return chunks;
+};
@@ -0,0 +1,14 @@
+// Counts code points rather than UTF-16 units, so an emoji is never cut in half
+export const truncateText = (text: string, maxLength: number): string => {
+  if (text.length <= maxLength) {
+    return text;
+  }
+
+  const chars = Array.from(text);
+
+  if (chars.length <= maxLength) {
+    return text;
+  }
+
+  return `${chars.slice(0, Math.max(0, maxLength - 1)).join('')}…`;
+};
@@ -0,0 +1,98 @@
+import 'reflect-metadata';
+
+import { strict as assert } from 'assert';
+import { Type } from 'class-transformer';
+import { IsInt, IsOptional, IsString, Min, ValidateIf, ValidateNested } from 'class-validator';
+import { describe, it } from 'node:test';
+
+import { AppError } from '../common/errors';
+
+import { IsExclusiveWith, validateConfig, ValidateRecord } from './validate-config';
+
+class LimitConfig {
+  @IsInt()
+  @Min(1)
+  limit: number;
+}
+
+class TestConfig {
+  @IsString()
+  name: string;
+
+  @IsOptional()
+  @ValidateNested()
+  @Type(() => LimitConfig)
+  defaults?: LimitConfig;
+
+  @IsOptional()
+  @ValidateRecord(() => LimitConfig)
+  channels?: Record<string, LimitConfig>;
+}
+
+// Exactly one of the two options is set
+class ExclusiveConfig {
+  @ValidateIf(
+    (config: ExclusiveConfig) => config.pattern === undefined || config.text !== undefined,
+  )
+  @IsString()
+  @IsExclusiveWith('pattern')
+  text?: string;
+
+  @ValidateIf((config: ExclusiveConfig) => config.text === undefined)
+  @IsString()
+  pattern?: string;
+}
+
+const getError = (config: object): string => {
+  try {
+    validateConfig(TestConfig, config as TestConfig);
+  } catch (error) {
+    if (!(error instanceof AppError)) {
+      throw error;
+    }
+
+    return error.message;
+  }
+
+  return assert.fail('Expected the config to be invalid');
+};
+
+describe('validateConfig', () => {
+  it('returns a valid config as is', () => {
+    const config = { name: 'bot', channels: { '1': { limit: 2 } } };
+
+    assert.equal(validateConfig(TestConfig, config), config);
+  });
+
+  it('lists every error with the path of the option', () => {
+    const error = getError({ name: 1, defaults: { limit: 0 } });
+
+    assert.match(error, /^Invalid TestConfig:/);
+    assert.match(error, /- name must be a string/);
+    assert.match(error, /- defaults\.limit must not be less than 1/);
+  });
+
+  it('validates every entry of a record', () => {
+    const error = getError({ name: 'bot', channels: { '1': { limit: 2 }, '2': {} } });
+
+    assert.match(error, /channels has invalid entries: .*2\.limit must not be less than 1/);
+    assert.doesNotMatch(error, /\b1\.limit/);
+  });
+
+  it('rejects a record entry that is not an object', () => {
+    assert.match(
+      getError({ name: 'bot', channels: { '1': 5 } }),
+      /channels has invalid entries: 1 must be an object/,
+    );
+  });
+
+  it('requires exactly one of two exclusive options', () => {
+    assert.equal(validateConfig(ExclusiveConfig, { pattern: 'hi' }).pattern, 'hi');
+    assert.equal(validateConfig(ExclusiveConfig, { text: 'hi' }).text, 'hi');
+    assert.throws(() => validateConfig(ExclusiveConfig, {}), /- text must be a string/);
+    assert.throws(
+      () => validateConfig(ExclusiveConfig, { text: 'hi', pattern: 'hi' }),
+      /- text cannot be set together with pattern/,
+    );
+  });
+});
@@ -0,0 +1,83 @@
+import { ClassConstructor, plainToInstance } from 'class-transformer';
+import {
+  buildMessage,
+  ValidateBy,
+  validateSync,
+  ValidationError,
+  ValidationOptions,
+} from 'class-validator';
+
+import { AppError } from '../common/errors';
+
+const formatErrors = (errors: ValidationError[], path: string = ''): string[] =>
+  errors.flatMap((error) => [
+    ...Object.values(error.constraints ?? {}).map((message) => `- ${path}${message}`),
+    ...formatErrors(error.children ?? [], `${path}${error.property}.`),
+  ]);
+
+export const validateConfig = <T extends object>(type: ClassConstructor<T>, config: T): T => {
+  const errors = validateSync(plainToInstance(type, config));
+
+  if (errors.length) {
+    throw new AppError(`Invalid ${type.name}:\n${formatErrors(errors).join('\n')}`);
+  }
+
+  return config;
+};
+
+const getRecordErrors = (type: ClassConstructor<object>, record: unknown): string[] => {
+  if (record === null || typeof record !== 'object' || Array.isArray(record)) {
+    return ['must be an object'];
+  }
+
+  return Object.entries(record).flatMap(([key, value]) =>
+    value === null || typeof value !== 'object' || Array.isArray(value)
+      ? [`${key} must be an object`]
+      : formatErrors(validateSync(plainToInstance(type, value)), `${key}.`).map((error) =>
+          error.slice(2),
+        ),
+  );
+};
+
+// Validates every value of a map keyed by arbitrary strings, e.g. guild ids or model names,
+// which @ValidateNested cannot do
+export const ValidateRecord = (
+  type: () => ClassConstructor<object>,
+  validationOptions?: ValidationOptions,
+): PropertyDecorator =>
+  ValidateBy(
+    {
+      name: 'validateRecord',
+      validator: {
+        validate: (value) => getRecordErrors(type(), value).length === 0,
+        defaultMessage: buildMessage(
+          (eachPrefix, args) =>
+            `${eachPrefix}$property has invalid entries: ` +
+            getRecordErrors(type(), args?.value).join(', '),
+          validationOptions,
+        ),
+      },
+    },
+    validationOptions,
+  );
+
+// For options that are alternatives to each other, at most one of which may be set
+export const IsExclusiveWith = (
+  property: string,
+  validationOptions?: ValidationOptions,
+): PropertyDecorator =>
+  ValidateBy(
+    {
+      name: 'isExclusiveWith',
+      constraints: [property],
+      validator: {
+        validate: (value, args) =>
+          value === undefined || (args?.object as Record<string, unknown>)[property] === undefined,
+        defaultMessage: buildMessage(
+          (eachPrefix) => `${eachPrefix}$property cannot be set together with $constraint1`,
+          validationOptions,
+        ),
+      },
+    },
+    validationOptions,
+  );